@@ -0,0 +1,135 @@
+package client
+
+import (
+	"fmt"
+	"github.com/emqx/wormhole/common"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The targets that the agent is allowed to expose, so that the tunnel cannot be used to reach arbitrary hosts in
+// the network of agent. A nil allowlist allows all targets.
+type allowlist struct {
+	targets []common.AllowTargetConfig
+}
+
+// The allowlist is enabled unless it's disabled explicitly. The advertised services are allowed as well, since they
+// are declared in the agent side.
+func newAllowlist(enable *bool, targets []common.AllowTargetConfig, services []common.Service) *allowlist {
+	if enable != nil && !*enable {
+		common.Log.Warnf("The allowlist is disabled, all targets requested by server are allowed.")
+		return nil
+	}
+	if len(targets) == 0 && len(services) == 0 {
+		common.Log.Warnf("The allowlist is empty, all targets requested by server are refused. Declare the targets or services, or disable the allowlist explicitly.")
+	}
+	targets = append([]common.AllowTargetConfig{}, targets...)
+	for _, s := range services {
+		targets = append(targets, common.AllowTargetConfig{Type: s.Type, Host: s.Host, Port: s.Port, PathPrefix: s.Path})
+	}
+	a := &allowlist{}
+	for _, t := range targets {
+		if t.Type == "" {
+			t.Type = common.MiddlewareHTTP
+		}
+		if t.Host == "" {
+			t.Host = "127.0.0.1"
+		}
+		t.Host = strings.ToLower(t.Host)
+		a.targets = append(a.targets, t)
+	}
+	return a
+}
+
+// Return an error if the target of http request is not allowed
+func (a *allowlist) checkHttp(r common.HttpRequest) error {
+	if a == nil {
+		return nil
+	}
+	u, err := url.Parse(r.ToString())
+	if err != nil {
+		return err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	p := path.Clean("/" + u.Path)
+	for _, t := range a.targets {
+		if t.Type == common.MiddlewareHTTP && matchAddr(t, u.Hostname(), port) && matchPrefix(t.PathPrefix, p) && matchMethod(t.Methods, r.Method) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s is not in the allowlist", r.Method, u.Redacted())
+}
+
+// Return an error if the tcp target is not allowed
+func (a *allowlist) checkTcp(host string, port int) error {
+	if a == nil {
+		return nil
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	for _, t := range a.targets {
+		if t.Type == common.MiddlewareTCP && matchAddr(t, host, strconv.Itoa(port)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("tcp %s is not in the allowlist", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// The host is compared literally, so localhost doesn't match 127.0.0.1
+func matchAddr(t common.AllowTargetConfig, host, port string) bool {
+	return t.Host == strings.ToLower(host) && strconv.Itoa(t.Port) == port
+}
+
+// Return an error if the health target is not allowed, so that the health checking cannot be used to scan the
+// network of agent. The connection is allowed if any target of the same address is allowed.
+func (a *allowlist) checkHealth(t common.HealthTarget) error {
+	if a == nil {
+		return nil
+	}
+	if t.Path != "" {
+		return a.checkHttp(healthRequest(t))
+	}
+	host := t.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	for _, at := range a.targets {
+		if matchAddr(at, host, strconv.Itoa(t.Port)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not in the allowlist", net.JoinHostPort(host, strconv.Itoa(t.Port)))
+}
+
+func matchPrefix(prefix, p string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(p, prefix)
+	}
+	// The prefix matches whole segments only, so /api doesn't match /apix
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+func matchMethod(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
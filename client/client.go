@@ -1,17 +1,21 @@
 package client
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
 	"github.com/emqx/wormhole/common"
 	quic "github.com/lucas-clemente/quic-go"
-	"io/ioutil"
+	"go.opentelemetry.io/otel/semconv"
+	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -19,8 +23,39 @@ import (
 type QCClient struct {
 	Server     string
 	Identifier string
+	Secret     string
+	TlsConf    *tls.Config
+	Session    quic.Session
 	Stream     quic.Stream
 	cancel     context.CancelFunc
+	// The count of reconnections to server
+	Reconnects int64
+	// Whether the client is registered in current connection, 1 means registered
+	registered int32
+	closed     int32
+	// The compressions and encodings supported by the agent
+	Compressions []string
+	Encodings    []string
+	Threshold    int
+	// The settings negotiated with server in current connection
+	negotiated atomic.Value
+	// The transports to the targets of middlewares
+	targets transports
+	// The targets allowed to be exposed, all targets are allowed if it's nil
+	allowlist *allowlist
+	// The local services advertised to server
+	Services []common.Service
+	// The health checker of middlewares, nil if it's disabled
+	health *healthChecker
+	// Serialize the writes to control stream
+	writeMu sync.Mutex
+}
+
+// The settings negotiated with server when registering
+type negotiation struct {
+	compression  *common.Compression
+	encoding     string
+	capabilities []string
 }
 
 func NewClient() {
@@ -43,170 +78,493 @@ func NewClient() {
 		}
 	}
 
+	// The secret is not accepted in command line, which is exposed to the other users of the host
+	secret := conf.Basic.Secret
+	if secret == "" {
+		secret = os.Getenv("WORMHOLE_AGENT_SECRET")
+	}
+	if secret == "" {
+		common.Log.Warnf("The agent secret is found in neither yaml nor environment variable WORMHOLE_AGENT_SECRET.")
+	}
+
 	common.Log.Printf("The node identifier is %s\n", id)
-	qcc := QCClient{Server: fmt.Sprintf("%s:%d", conf.Basic.Server, conf.Basic.Port), Identifier: id}
+	tlsConf, err := createTLSConfig(conf.Tls)
+	if err != nil {
+		fmt.Printf("Failed to init tls: %v, exiting...\n", err)
+		return
+	}
+	common.SetMaxFrameSize(conf.Basic.MaxFrameSize)
+	qcc := QCClient{
+		Server:       fmt.Sprintf("%s:%d", conf.Basic.Server, conf.Basic.Port),
+		Identifier:   id,
+		Secret:       secret,
+		TlsConf:      tlsConf,
+		Compressions: conf.Compression.Algorithms,
+		Encodings:    conf.Basic.Encodings,
+		Threshold:    conf.Compression.GetThreshold(),
+		allowlist:    newAllowlist(conf.Allowlist.Enable, conf.Allowlist.Targets, conf.Services),
+		Services:     conf.Services,
+		health:       newHealthChecker(conf.Health.Interval, conf.Health.Timeout),
+	}
 
-	err := qcc.clientMain()
+	shutdownTracing, err := common.InitTracing(conf.Tracing, "wormhole-agent", semconv.ServiceInstanceIDKey.String(id))
 	if err != nil {
-		panic(err)
+		fmt.Printf("Failed to init tracing: %v, exiting...\n", err)
+		return
+	}
+
+	if conf.Metrics.Port > 0 {
+		go qcc.serveMetrics(conf.Metrics.BindAddr, conf.Metrics.Port)
 	}
 
+	if qcc.health != nil {
+		go qcc.checkHealth()
+	}
+
+	rand.Seed(time.Now().UnixNano())
+	go qcc.run(conf.Reconnect.InitialInterval, conf.Reconnect.MaxInterval)
+
 	sigint := make(chan os.Signal, 1)
 	signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
 	<-sigint
-	qcc.cancel()
+	qcc.close()
+	shutdownTracing()
 	os.Exit(0)
 }
 
-func (qcc *QCClient) sendRequest(r common.HttpRequest) (*http.Response, error) {
+// Keep the connection to server, redial with jittered exponential backoff once the connection is lost
+func (qcc *QCClient) run(initialInterval, maxInterval int) {
+	if initialInterval <= 0 {
+		initialInterval = 1
+	}
+	if maxInterval < initialInterval {
+		maxInterval = initialInterval
+	}
+	initial, max := time.Duration(initialInterval)*time.Second, time.Duration(maxInterval)*time.Second
+	for attempt := 0; ; attempt++ {
+		atomic.StoreInt32(&qcc.registered, 0)
+		qcc.negotiated.Store(&negotiation{})
+		err := qcc.clientMain()
+		if atomic.LoadInt32(&qcc.closed) == 1 {
+			return
+		}
+		if atomic.LoadInt32(&qcc.registered) == 1 {
+			attempt = 0
+		}
+		delay := backoff(attempt, initial, max)
+		reconnects := atomic.AddInt64(&qcc.Reconnects, 1)
+		common.Log.Errorf("The connection to server %s is lost: %v, reconnecting in %s (reconnect #%d).", qcc.Server, err, delay, reconnects)
+		time.Sleep(delay)
+	}
+}
+
+// Return the delay before next reconnect, which is a random value in [d/2, d) and d = initial * 2^attempt
+func backoff(attempt int, initial, max time.Duration) time.Duration {
+	d := initial
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+func (qcc *QCClient) close() {
+	atomic.StoreInt32(&qcc.closed, 1)
+	if qcc.cancel != nil {
+		qcc.cancel()
+	}
+	if qcc.Session != nil {
+		qcc.Session.CloseWithError(0, "client exits")
+	}
+}
+
+// Send the request to service, the request is cancelled once the context is done
+func (qcc *QCClient) sendRequest(ctx context.Context, r common.HttpRequest, body io.Reader) (*http.Response, error) {
 	common.Log.Debugf("URL is: %s", r.ToString())
-	if req, error := http.NewRequest(r.Method, r.ToString(), bytes.NewBuffer(r.Body)); error != nil {
+	if req, error := http.NewRequestWithContext(ctx, r.Method, r.ToString(), body); error != nil {
 		common.Log.Errorf("Find error %s when producing request %v.", error, r)
 		return nil, error
 	} else {
 		req.Header = r.Headers
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-		client := &http.Client{}
+		req.ContentLength = r.ContentLength
+		if req.ContentLength == 0 {
+			req.Body = http.NoBody
+		}
+		client, err := qcc.targets.client(r)
+		if err != nil {
+			return nil, err
+		}
 		return client.Do(req)
 	}
 }
 
-func (qcc *QCClient) clientMain() error {
+// Create the TLS config to verify the server with the pinned CA, the client certificate is presented if configured
+func createTLSConfig(conf common.TlsConfig) (*tls.Config, error) {
 	tlsConf := &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"emqx-wormhole"},
+		ServerName: conf.ServerName,
+		NextProtos: []string{"emqx-wormhole"},
+	}
+	switch {
+	case conf.Insecure:
+		common.Log.Warnf("The server certificate is not verified since insecure is enabled.")
+		tlsConf.InsecureSkipVerify = true
+	case conf.CaFile != "":
+		pool, err := common.LoadCertPool(conf.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.RootCAs = pool
+	}
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load certificate %s and key %s: %v", conf.CertFile, conf.KeyFile, err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
 	}
+	return tlsConf, nil
+}
 
-	session, err := quic.DialAddr(qcc.Server, tlsConf, &quic.Config{KeepAlive: true, HandshakeTimeout: 10 * time.Second})
+func (qcc *QCClient) clientMain() error {
+	session, err := quic.DialAddr(qcc.Server, qcc.TlsConf, &quic.Config{KeepAlive: true, HandshakeTimeout: 10 * time.Second})
 	if err != nil {
 		return err
 	}
 
-	context, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
 	qcc.cancel = cancel
-	stream, err := session.OpenStreamSync(context)
+	defer session.CloseWithError(0, "connection closed")
+	stream, err := session.OpenStreamSync(ctx)
 	if err != nil {
+		cancel()
 		return err
 	}
+	qcc.Session = session
 	qcc.Stream = stream
-	if e := qcc.Register(); e != nil {
-		return e
-	}
-	return nil
+	go qcc.acceptStreams(ctx)
+	return qcc.Register()
 }
 
-func (qcc *QCClient) WriteTo(con interface{}) error {
-	j, e := json.Marshal(con)
-	if e != nil {
-		return e
-	}
-	if _, err := common.NewWriter(qcc.Stream).Write(j); err != nil {
-		return fmt.Errorf("Found error when sending out request - %t", err)
+func (qcc *QCClient) WriteTo(stream quic.Stream, con interface{}) error {
+	if err := qcc.newWriter(stream).WriteMessage(con); err != nil {
+		return fmt.Errorf("Found error when sending out request - %w", err)
 	} else {
-		common.Log.Infof("Request %s is sent out successfully. Waiting for the response.", j)
+		common.Log.Infof("Request %T is sent out successfully. Waiting for the response.", con)
 	}
 	return nil
 }
 
-func (qcc *QCClient) onCommand(cmd *common.HttpCommand) error {
-	//fmt.Printf("%T - %v", cmd.Payload, cmd)
-	if response, err1 := qcc.sendRequest(cmd.HttpRequest); err1 != nil {
-		return qcc.WriteTo(common.BasicResponse{
+// Process the http command, the request body and response body are streamed through the command stream
+func (qcc *QCClient) onCommand(stream quic.Stream, cmd *common.HttpCommand) error {
+	if err := qcc.allowlist.checkHttp(cmd.HttpRequest); err != nil {
+		return qcc.refuse(stream, &cmd.BasicCommand, err)
+	}
+	if common.IsUpgradeRequest(cmd.Headers) {
+		return qcc.onUpgrade(stream, cmd)
+	}
+	// The context of stream is cancelled when server aborts the stream
+	ctx, span := qcc.startUpstreamSpan(stream.Context(), cmd)
+	start := time.Now()
+	response, err1 := qcc.sendRequest(ctx, cmd.HttpRequest, qcc.newBodyReader(stream))
+	upstream := time.Since(start)
+	endUpstreamSpan(span, response, err1)
+	if err1 != nil {
+		return qcc.writeResponse(stream, &common.BasicResponse{
 			Identifier:   qcc.Identifier,
 			ResponseType: common.BASIC_R,
 			Sequence:     cmd.Sequence,
 			Code:         common.ERROR_FOUND,
 			Description:  err1.Error(),
-		})
+		}, nil)
 	} else {
+		defer response.Body.Close()
 		common.Log.Debugf("headers from remote server %v", response.Header)
-		if c, e := getContent(*response); e != nil {
-			return qcc.WriteTo(common.BasicResponse{
-				Identifier:   qcc.Identifier,
-				ResponseType: common.BASIC_R,
-				Sequence:     cmd.Sequence,
-				Code:         common.ERROR_FOUND,
-				Description:  e.Error(),
-			})
-		} else {
-			return qcc.WriteTo(
-				common.HttpResponse{
-					BasicResponse: common.BasicResponse{
-						ResponseType: common.HTTP_R,
-						Identifier:   qcc.Identifier,
-						Sequence:     cmd.Sequence,
-						Code:         common.OK,
-					},
-					Header:           response.Header,
-					HttpResponseCode: response.StatusCode,
-					HttpResponseText: response.Status,
-					Body:             c,
-				})
+		return qcc.writeResponse(stream,
+			&common.HttpResponse{
+				BasicResponse: common.BasicResponse{
+					ResponseType: common.HTTP_R,
+					Identifier:   qcc.Identifier,
+					Sequence:     cmd.Sequence,
+					Code:         common.OK,
+				},
+				Header:           response.Header,
+				HttpResponseCode: response.StatusCode,
+				HttpResponseText: response.Status,
+				UpstreamTime:     int64(upstream),
+			}, &responseBody{response})
+	}
+}
+
+func (qcc *QCClient) writeError(stream quic.Stream, sequence int, err error) error {
+	return qcc.writeResponse(stream, &common.BasicResponse{
+		Identifier:   qcc.Identifier,
+		ResponseType: common.BASIC_R,
+		Sequence:     sequence,
+		Code:         common.ERROR_FOUND,
+		Description:  err.Error(),
+	}, nil)
+}
+
+// Audit the command whose target is not in the allowlist, and reply FORBIDDEN
+func (qcc *QCClient) refuse(stream quic.Stream, cmd *common.BasicCommand, err error) error {
+	common.Log.Warnf("[audit] Refused command %d of type %s from server %s: %v", cmd.Sequence, cmdTypeName(cmd.CType), qcc.Server, err)
+	refusedTotal.WithLabelValues(cmdTypeName(cmd.CType)).Inc()
+	return qcc.writeResponse(stream, &common.BasicResponse{
+		Identifier:   qcc.Identifier,
+		ResponseType: common.BASIC_R,
+		Sequence:     cmd.Sequence,
+		Code:         common.FORBIDDEN,
+		Description:  err.Error(),
+	}, nil)
+}
+
+// Write the response followed by the streamed body
+func (qcc *QCClient) writeResponse(stream quic.Stream, resp common.Response, body io.Reader) error {
+	if err := qcc.WriteTo(stream, resp); err != nil {
+		if common.AsProtocolError(err) != nil {
+			// Nothing is written if the response exceeds the max frame size, so the error is reported instead
+			return qcc.writeError(stream, resp.GetSequence(), err)
 		}
+		return err
 	}
-	return nil
+	bw := qcc.newBodyWriter(stream)
+	if body != nil {
+		if _, err := io.Copy(bw, body); err != nil {
+			stream.CancelWrite(0)
+			return fmt.Errorf("Found error when sending out response body - %v", err)
+		}
+	}
+	if rb, ok := body.(*responseBody); ok && qcc.getNegotiation().has(common.CapTrailers) {
+		if trailer := rb.trailers(); len(trailer) > 0 {
+			if err := bw.WriteTrailer(trailer); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Close()
 }
 
-func getContent(resp http.Response) ([]byte, error) {
-	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+// The body of the response from service, its trailers are available after reading the body to io.EOF
+type responseBody struct {
+	*http.Response
 }
 
-func (qcc *QCClient) onResponse(response *common.BasicResponse) {
-	common.Log.Printf("Get response from rest %s.", response)
+func (rb *responseBody) Read(p []byte) (int, error) {
+	return rb.Body.Read(p)
 }
 
-func (qcc *QCClient) ListenToSrv() {
+// The trailers with values, the announced trailers which are not sent are dropped
+func (rb *responseBody) trailers() http.Header {
+	trailer := http.Header{}
+	for k, vs := range rb.Trailer {
+		if len(vs) > 0 {
+			trailer[k] = vs
+		}
+	}
+	return trailer
+}
+
+// Return the settings negotiated in current connection
+func (qcc *QCClient) getNegotiation() *negotiation {
+	if n, ok := qcc.negotiated.Load().(*negotiation); ok {
+		return n
+	}
+	return &negotiation{}
+}
+
+// Whether the capability is negotiated with server
+func (n *negotiation) has(c string) bool {
+	return common.HasCapability(n.capabilities, c)
+}
+
+// The writers and readers of current connection, with the negotiated compression and encoding
+func (qcc *QCClient) newWriter(w io.Writer) *common.Writer {
+	n := qcc.getNegotiation()
+	return common.NewCompressedWriter(w, n.compression).WithEncoding(n.encoding)
+}
+
+func (qcc *QCClient) newReader(r io.Reader) *common.Reader {
+	return common.NewCompressedReader(r, qcc.getNegotiation().compression)
+}
+
+func (qcc *QCClient) newBodyWriter(w io.Writer) *common.BodyWriter {
+	return common.NewCompressedBodyWriter(w, qcc.getNegotiation().compression)
+}
+
+func (qcc *QCClient) newBodyReader(stream quic.Stream) io.Reader {
+	return common.NewStreamBody(stream, common.NewCompressedBodyReader(stream, qcc.getNegotiation().compression), qcc.onProtocolError)
+}
+
+// Count the protocol violation of server, the offending stream is aborted by the caller
+func (qcc *QCClient) onProtocolError(pe *common.ProtocolError) {
+	common.Log.Errorf("The server violates the protocol: %v", pe)
+	protocolErrorsTotal.WithLabelValues(pe.Reason).Inc()
+}
+
+func (qcc *QCClient) onResponse(response *common.RegisterResponse) {
+	common.Log.Printf("Get response from rest %v.", response)
+	if response.Code == common.OK {
+		n := &negotiation{encoding: response.Encoding, capabilities: response.Capabilities}
+		if response.Compression != "" {
+			n.compression = common.NewCompression(response.Compression, qcc.Threshold)
+			common.Log.Infof("The payloads to server are compressed with %s.", response.Compression)
+		}
+		qcc.negotiated.Store(n)
+		// The server pushes the health targets after registering
+		qcc.health.setTargets(nil, 0)
+		common.Log.Infof("The agent is registered to server of version %s with capabilities %v.", response.Version, response.Capabilities)
+		atomic.StoreInt32(&qcc.registered, 1)
+		return
+	}
+	if response.Code == common.INCOMPATIBLE_VERSION {
+		common.Log.Errorf("The agent version %s is incompatible with server version %s, please upgrade the agent.",
+			common.VersionString(common.ProtocolVersion), response.Version)
+	} else {
+		common.Log.Errorf("The registration is rejected with code %d: %s", response.Code, response.Description)
+	}
+	// The agent is not served until it's registered, so close the connection to register again after backoff
+	qcc.Session.CloseWithError(0, "the registration is rejected")
+}
+
+// Listen to the control stream until the connection is broken
+func (qcc *QCClient) ListenToSrv() error {
 	for {
-		if rawData, err := common.NewReader(qcc.Stream).Read(); err != nil {
+		header, rawData, err := qcc.newReader(qcc.Stream).ReadPackage()
+		if err != nil {
+			if pe := common.AsProtocolError(err); pe != nil {
+				// The control stream cannot be recovered, so reconnect to server
+				qcc.onProtocolError(pe)
+				qcc.Session.CloseWithError(common.ProtocolErrorCode, pe.Error())
+			}
 			qcc.cancel()
-			break
-		} else {
-			result := map[string]interface{}{}
-			if e := json.Unmarshal(rawData, &result); e != nil {
-				common.Log.Errorf("Found error when trying to unmarshal data from server %s", rawData)
+			return err
+		}
+		m, err := common.DecodeMessage(header, rawData)
+		if err != nil {
+			common.Log.Errorf("Found error when trying to decode data from server: %v", err)
+			continue
+		}
+		switch msg := m.(type) {
+		case *common.RegisterResponse:
+			qcc.onResponse(msg)
+		case *common.BasicResponse:
+			// The response of legacy server
+			qcc.onResponse(&common.RegisterResponse{BasicResponse: *msg})
+		case *common.HeartbeatCommand:
+			if msg.CType == common.PING {
+				qcc.onPing(msg)
 			} else {
-				if result["Code"] != nil {
-					response := common.BasicResponse{}
-					err := json.Unmarshal(rawData, &response)
-					if err != nil {
-						common.Log.Errorf("Invalid response packet from server %s", err)
-					} else {
-						qcc.onResponse(&response)
-					}
-					continue
-				} else if t := result["CType"]; t != nil {
-					common.Log.Debugf("%s", rawData)
-					t1, _ := t.(float64)
-					if common.HTTP == common.CmdType(int64(t1)) {
-						hcmd := common.HttpCommand{}
-						err := json.Unmarshal(rawData, &hcmd)
-						if err != nil {
-							common.Log.Errorf("Invalid packet from server %s", err)
-						} else {
-							if err := qcc.onCommand(&hcmd); err != nil {
-								common.Log.Errorf("Failed to process command %s", err)
-							}
-						}
-					} else {
-						common.Log.Errorf("Not supported command type %d", common.CmdType(int64(t1)))
-					}
-					continue
-				}
-				common.Log.Errorf("Invalid result %s", rawData)
+				common.Log.Errorf("Not supported command type %d in control stream", msg.CType)
 			}
+		case *common.HealthTargetsCommand:
+			qcc.onHealthTargets(msg)
+		default:
+			common.Log.Errorf("Invalid message %T in control stream", m)
 		}
 	}
 }
 
-func (qcc *QCClient) Register() error {
-	cmd := common.BasicCommand{
-		Identifier: qcc.Identifier,
-		CType:      common.REGISTER,
+// Echo the ping back as pong with the same sequence and timestamp
+func (qcc *QCClient) onPing(cmd *common.HeartbeatCommand) {
+	cmd.Identifier = qcc.Identifier
+	cmd.CType = common.PONG
+	if err := qcc.writeControl(cmd); err != nil {
+		common.Log.Errorf("Failed to send pong to server: %v", err)
+	}
+}
+
+// Write the message to the control stream, the writes from different goroutines are serialized
+func (qcc *QCClient) writeControl(m interface{}) error {
+	qcc.writeMu.Lock()
+	defer qcc.writeMu.Unlock()
+	return qcc.newWriter(qcc.Stream).WriteMessage(m)
+}
+
+// Accept the streams opened by server, every stream carries exactly one command and its response
+func (qcc *QCClient) acceptStreams(ctx context.Context) {
+	for {
+		stream, err := qcc.Session.AcceptStream(ctx)
+		if err != nil {
+			common.Log.Errorf("Stop accepting streams from server: %v", err)
+			return
+		}
+		go qcc.handleStream(stream)
 	}
-	if err := qcc.WriteTo(cmd); err != nil {
+}
+
+func (qcc *QCClient) handleStream(stream quic.Stream) {
+	defer stream.Close()
+	defer stream.CancelRead(0)
+	m, err := qcc.newReader(stream).ReadMessage()
+	if err != nil {
+		common.Log.Errorf("Found error when reading command from stream %d: %v", stream.StreamID(), err)
+		if pe := common.AsProtocolError(err); pe != nil {
+			qcc.onProtocolError(pe)
+			stream.CancelRead(common.ProtocolErrorCode)
+		}
+		return
+	}
+	switch cmd := m.(type) {
+	case *common.HttpCommand:
+		common.Log.Debugf("%s", cmd.Json())
+		done := trackCommand(cmd.CType)
+		defer done()
+		if err := qcc.onCommand(stream, cmd); err != nil {
+			common.Log.Errorf("Failed to process command %s", err)
+		}
+	case *common.TcpCommand:
+		common.Log.Debugf("%s", cmd.Json())
+		done := trackCommand(cmd.CType)
+		defer done()
+		if err := qcc.onTcpCommand(stream, cmd); err != nil {
+			common.Log.Errorf("Failed to process command %s", err)
+		}
+	default:
+		common.Log.Errorf("Not supported command %T", m)
+	}
+}
+
+// Connect to the target and pipe the data between the target and the stream
+func (qcc *QCClient) onTcpCommand(stream quic.Stream, cmd *common.TcpCommand) error {
+	if err := qcc.allowlist.checkTcp(cmd.Host, cmd.Port); err != nil {
+		return qcc.refuse(stream, &cmd.BasicCommand, err)
+	}
+	host := cmd.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	target, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(cmd.Port)), 10*time.Second)
+	if err != nil {
+		return qcc.writeError(stream, cmd.Sequence, err)
+	}
+	defer target.Close()
+	go func() {
+		if _, err := io.Copy(target, qcc.newBodyReader(stream)); err != nil {
+			common.Log.Debugf("The forward to %s is broken: %v", target.RemoteAddr(), err)
+		}
+		if tc, ok := target.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+	return qcc.writeResponse(stream, &common.BasicResponse{
+		Identifier:   qcc.Identifier,
+		ResponseType: common.BASIC_R,
+		Sequence:     cmd.Sequence,
+		Code:         common.OK,
+	}, target)
+}
+
+func (qcc *QCClient) Register() error {
+	cmd := common.NewRegisterCommand(qcc.Identifier, qcc.Secret)
+	cmd.Compressions = qcc.Compressions
+	cmd.Encodings = qcc.Encodings
+	cmd.Capabilities = common.SupportedCapabilities
+	cmd.Services = qcc.Services
+	if err := qcc.WriteTo(qcc.Stream, cmd); err != nil {
 		return err
 	}
-	qcc.ListenToSrv()
-	return nil
+	return qcc.ListenToSrv()
 }
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/emqx/wormhole/common"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The checker probes the health targets pushed by server periodically, and reports the health of a target to server
+// once it's checked for the first time or changed
+type healthChecker struct {
+	interval time.Duration
+	timeout  time.Duration
+	mu       sync.Mutex
+	targets  []common.HealthTarget
+	// The last reported health by target name, and the generation of targets which it belongs to
+	reported   map[string]bool
+	generation int
+	// The generation of targets assigned by server, which is carried in the reports
+	serverGeneration int64
+	wake             chan struct{}
+}
+
+// Create the health checker, nil means the health checking is disabled
+func newHealthChecker(interval, timeout int) *healthChecker {
+	if interval < 0 {
+		return nil
+	}
+	hc := &healthChecker{interval: 10 * time.Second, timeout: 3 * time.Second, wake: make(chan struct{}, 1)}
+	if interval > 0 {
+		hc.interval = time.Duration(interval) * time.Second
+	}
+	if timeout > 0 {
+		hc.timeout = time.Duration(timeout) * time.Second
+	}
+	return hc
+}
+
+// Replace the targets, all of them are checked and reported immediately
+func (hc *healthChecker) setTargets(targets []common.HealthTarget, serverGeneration int64) {
+	if hc == nil {
+		return
+	}
+	hc.mu.Lock()
+	hc.targets = targets
+	hc.serverGeneration = serverGeneration
+	hc.reported = make(map[string]bool)
+	hc.generation++
+	hc.mu.Unlock()
+	select {
+	case hc.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (qcc *QCClient) onHealthTargets(cmd *common.HealthTargetsCommand) {
+	common.Log.Debugf("Got %d health targets from server.", len(cmd.Targets))
+	qcc.health.setTargets(cmd.Targets, cmd.Generation)
+}
+
+// Check the health of targets until the agent exits, the targets are only checked when the agent is registered
+func (qcc *QCClient) checkHealth() {
+	hc := qcc.health
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-hc.wake:
+		}
+		if atomic.LoadInt32(&qcc.registered) == 0 || !qcc.getNegotiation().has(common.CapHealth) {
+			continue
+		}
+		hc.mu.Lock()
+		targets, generation := hc.targets, hc.generation
+		hc.mu.Unlock()
+		var wg sync.WaitGroup
+		for _, t := range targets {
+			wg.Add(1)
+			go func(t common.HealthTarget) {
+				defer wg.Done()
+				if err := qcc.allowlist.checkHealth(t); err != nil {
+					common.Log.Debugf("The health of %s is not checked: %v", t.Name, err)
+					return
+				}
+				qcc.reportHealth(t.Name, generation, qcc.probe(t))
+			}(t)
+		}
+		wg.Wait()
+	}
+}
+
+// Send the health of target to server if it's changed since the last report
+func (qcc *QCClient) reportHealth(name string, generation int, err error) {
+	hc := qcc.health
+	healthy := err == nil
+	hc.mu.Lock()
+	last, ok := hc.reported[name]
+	if generation != hc.generation || (ok && last == healthy) {
+		hc.mu.Unlock()
+		return
+	}
+	hc.reported[name] = healthy
+	serverGeneration := hc.serverGeneration
+	hc.mu.Unlock()
+
+	report := &common.HealthReport{
+		BasicCommand: common.BasicCommand{Identifier: qcc.Identifier, Sequence: common.GetNextId(), CType: common.HEALTH},
+		Generation:   serverGeneration,
+		Name:         name,
+		Healthy:      healthy,
+	}
+	if err != nil {
+		report.Detail = err.Error()
+	}
+	if e := qcc.writeControl(report); e != nil {
+		common.Log.Errorf("Failed to report health of %s to server: %v", name, e)
+		// Report it again in the next round
+		hc.mu.Lock()
+		if generation == hc.generation {
+			delete(hc.reported, name)
+		}
+		hc.mu.Unlock()
+	}
+}
+
+// Request the http path of target, or connect to the target if the path is not set
+func (qcc *QCClient) probe(t common.HealthTarget) error {
+	timeout := qcc.health.timeout
+	if t.Path == "" {
+		host := t.Host
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(t.Port)), timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	r := healthRequest(t)
+	client, err := qcc.targets.client(r)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, r.Method, r.ToString(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("the health check %s returns %s", t.Path, resp.Status)
+	}
+	return nil
+}
+
+func healthRequest(t common.HealthTarget) common.HttpRequest {
+	return common.HttpRequest{
+		Schema:   t.Scheme,
+		Method:   http.MethodGet,
+		Host:     t.Host,
+		Port:     t.Port,
+		BasePath: t.Path,
+		Tls:      t.Tls,
+	}
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"fmt"
+	"github.com/emqx/wormhole/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sync/atomic"
+)
+
+var (
+	commandsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wormhole_agent",
+		Name:      "handled_commands_total",
+		Help:      "The count of commands received from server by command type.",
+	}, []string{"type"})
+	inflightCommands = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "wormhole_agent",
+		Name:      "inflight_commands",
+		Help:      "The count of commands in process.",
+	})
+	refusedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wormhole_agent",
+		Name:      "refused_commands_total",
+		Help:      "The count of commands refused since their targets are not in the allowlist, by command type.",
+	}, []string{"type"})
+	protocolErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wormhole_agent",
+		Name:      "protocol_errors_total",
+		Help:      "The count of protocol violations of server by reason, such as frame_too_large.",
+	}, []string{"reason"})
+)
+
+func cmdTypeName(t common.CmdType) string {
+	switch t {
+	case common.HTTP:
+		return "http"
+	case common.TCP:
+		return "tcp"
+	default:
+		return "unknown"
+	}
+}
+
+// Count the command, the returned function must be called once the command is processed
+func trackCommand(t common.CmdType) func() {
+	commandsTotal.WithLabelValues(cmdTypeName(t)).Inc()
+	inflightCommands.Inc()
+	return inflightCommands.Dec
+}
+
+// Expose the metrics of agent at /metrics of the local address
+func (qcc *QCClient) serveMetrics(addr string, port int) {
+	reconnects := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "wormhole_agent",
+		Name:      "reconnects_total",
+		Help:      "The count of reconnections to server.",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&qcc.Reconnects))
+	})
+	connected := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "wormhole_agent",
+		Name:      "connected",
+		Help:      "Whether the agent is connected and registered to server.",
+	}, func() float64 {
+		return float64(atomic.LoadInt32(&qcc.registered))
+	})
+	prometheus.MustRegister(commandsTotal, inflightCommands, refusedTotal, protocolErrorsTotal, reconnects, connected)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if err := http.ListenAndServe(fmt.Sprintf("%s:%d", addr, port), mux); err != nil {
+		common.Log.Errorf("Failed to serve metrics at %s:%d: %v", addr, port, err)
+	}
+}
@@ -0,0 +1,245 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/emqx/wormhole/common"
+	"github.com/emqx/wormhole/rest"
+	quic "github.com/lucas-clemente/quic-go"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The server config of the tests, the heartbeat is disabled to keep the connection quiet
+const testSrvConf = `basic:
+  commandTimeout: 10
+  maxCommandTimeout: 60
+  heartbeatInterval: -1
+log:
+  logPath: %s
+`
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "wormhole")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	conf := fmt.Sprintf(testSrvConf, filepath.Join(dir, "wormhole.log"))
+	if err := ioutil.WriteFile(filepath.Join(dir, "server.yaml"), []byte(conf), 0644); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Setenv("WORMHOLE_CONF_DIR", dir)
+	if _, ok := common.GetSrvConf(); !ok {
+		fmt.Println("failed to load the server config")
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// The upstream records what it receives, and responds with multi-value headers, the status code and trailers
+type upstream struct {
+	method string
+	path   string
+	query  string
+	header http.Header
+	body   string
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	u.method, u.path, u.query, u.header, u.body = req.Method, req.URL.EscapedPath(), req.URL.RawQuery, req.Header, string(body)
+	if strings.HasSuffix(u.path, "/redirect") {
+		http.Redirect(w, req, "http://example.invalid/next", http.StatusFound)
+		return
+	}
+	w.Header().Set("Trailer", "X-Checksum")
+	w.Header().Add("Set-Cookie", "a=1")
+	w.Header().Add("Set-Cookie", "b=2")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("hello " + u.body))
+	w.Header().Set("X-Checksum", "abc")
+}
+
+// Create the TLS config of the QUIC listener with a self-signed certificate
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: key}},
+		NextProtos:   []string{"emqx-wormhole"},
+	}
+}
+
+// Accept the agents like the wormhole server does
+func listenAgents(t *testing.T) quic.Listener {
+	listener, err := quic.ListenAddr("127.0.0.1:0", testTLSConfig(t), &quic.Config{KeepAlive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			sess, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				gstream, err := sess.AcceptStream(ctx)
+				if err != nil {
+					cancel()
+					return
+				}
+				common.NewQuicConnection(sess, gstream, cancel).ListenToClient()
+			}()
+		}
+	}()
+	return listener
+}
+
+// Proxy the requests through the rest server, the server connection and the agent to the upstream
+func TestProxyFidelity(t *testing.T) {
+	up := &upstream{}
+	backend := httptest.NewServer(up)
+	defer backend.Close()
+	_, p, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	port, _ := strconv.Atoi(p)
+
+	agent, err := common.GetAgentManager().Add(common.Agent{Name: "fidelity"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer common.GetAgentManager().DeleteById(agent.Identifier)
+	if _, err := common.GetMiddlewareManager().Add(agent.Identifier, common.Middleware{Name: "echo", Path: "/api/", Port: port}); err != nil {
+		t.Fatal(err)
+	}
+
+	listener := listenAgents(t)
+	defer listener.Close()
+	enable := true
+	qcc := &QCClient{
+		Server:     listener.Addr().String(),
+		Identifier: agent.Identifier,
+		Secret:     agent.Secret,
+		TlsConf:    &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"emqx-wormhole"}},
+		allowlist:  newAllowlist(&enable, []common.AllowTargetConfig{{Host: "127.0.0.1", Port: port}}, nil),
+	}
+	go qcc.run(1, 1)
+	defer qcc.close()
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(&qcc.registered) == 0 || common.GetManager().GetConn(agent.Identifier) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the agent is not registered in 10s")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	srv, err := rest.CreateRestServer("127.0.0.1", 0, common.AuthConfig{}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(srv.Handler)
+	defer front.Close()
+	// The redirects are returned to the caller as is
+	caller := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	tests := []struct {
+		method    string
+		target    string
+		body      string
+		wantPath  string
+		wantQuery string
+	}{
+		{http.MethodGet, "rules", "", "/api/rules", ""},
+		{http.MethodGet, "", "", "/api/", ""},
+		{http.MethodPost, "streams", "create", "/api/streams", ""},
+		{http.MethodPatch, "files/a%2Fb", "patch", "/api/files/a%2Fb", ""},
+		{http.MethodPut, "files/a%23b", "put", "/api/files/a%23b", ""},
+		{http.MethodDelete, "rules?a=1&a=2&b=%2F", "", "/api/rules", "a=1&a=2&b=%2F"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, front.URL+"/wh/"+agent.Identifier+"/echo/"+tt.target, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Add("X-Multi", "1")
+			req.Header.Add("X-Multi", "2")
+			resp, err := caller.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if up.method != tt.method {
+				t.Errorf("upstream got method %s, want %s", up.method, tt.method)
+			}
+			if up.path != tt.wantPath || up.query != tt.wantQuery {
+				t.Errorf("upstream got %s?%s, want %s?%s", up.path, up.query, tt.wantPath, tt.wantQuery)
+			}
+			if got := up.header.Values("X-Multi"); strings.Join(got, ";") != "1;2" {
+				t.Errorf("upstream got X-Multi %v, want [1 2]", got)
+			}
+			if up.body != tt.body {
+				t.Errorf("upstream got body %q, want %q", up.body, tt.body)
+			}
+			if resp.StatusCode != http.StatusCreated {
+				t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusCreated)
+			}
+			if cookies := resp.Header.Values("Set-Cookie"); strings.Join(cookies, ";") != "a=1;b=2" {
+				t.Errorf("got Set-Cookie %v, want [a=1 b=2]", cookies)
+			}
+			if want := "hello " + tt.body; string(body) != want {
+				t.Errorf("got body %q, want %q", body, want)
+			}
+			if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+				t.Errorf("got trailer X-Checksum %q, want %q", got, "abc")
+			}
+		})
+	}
+
+	t.Run("redirect", func(t *testing.T) {
+		resp, err := caller.Get(front.URL + "/wh/" + agent.Identifier + "/echo/redirect")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusFound {
+			t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusFound)
+		}
+		if got := resp.Header.Get("Location"); got != "http://example.invalid/next" {
+			t.Errorf("got Location %q, want %q", got, "http://example.invalid/next")
+		}
+	})
+}
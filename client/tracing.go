@@ -0,0 +1,43 @@
+package client
+
+import (
+	"context"
+	"github.com/emqx/wormhole/common"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+// Start the span of the request to service as a child of the span of server, and propagate it to the service
+// through the headers of request
+func (qcc *QCClient) startUpstreamSpan(ctx context.Context, cmd *common.HttpCommand) (context.Context, trace.Span) {
+	if cmd.Headers == nil {
+		cmd.Headers = http.Header{}
+	}
+	ctx = otel.GetTextMapPropagator().Extract(ctx, cmd.Headers)
+	ctx, span := common.Tracer().Start(ctx, "upstream "+cmd.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			common.AttrAgent.String(qcc.Identifier),
+			common.AttrSequence.Int(cmd.Sequence),
+			semconv.HTTPMethodKey.String(cmd.Method),
+			semconv.HTTPURLKey.String(cmd.ToString()),
+		))
+	otel.GetTextMapPropagator().Inject(ctx, cmd.Headers)
+	return ctx, span
+}
+
+func endUpstreamSpan(span trace.Span, resp *http.Response, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+	}
+	span.End()
+}
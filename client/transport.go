@@ -0,0 +1,139 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/emqx/wormhole/common"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The transports to the targets of middlewares. The transports are cached by the TLS settings, so that the
+// connections to the same target are reused and the targets with different settings are isolated.
+type transports struct {
+	mu    sync.Mutex
+	cache map[common.TargetTls]*http.Transport
+}
+
+// Return the transport for the target of request, the plain http targets share the same transport
+func (ts *transports) get(r common.HttpRequest) (*http.Transport, error) {
+	var key common.TargetTls
+	if r.Schema == "https" {
+		if r.Tls != nil {
+			key = *r.Tls
+		}
+		if key.Mode == "" {
+			key.Mode = common.TlsVerify
+		}
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if t, ok := ts.cache[key]; ok {
+		return t, nil
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if r.Schema == "https" {
+		conf, err := newTargetTLSConfig(key)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = conf
+	}
+	if ts.cache == nil {
+		ts.cache = make(map[common.TargetTls]*http.Transport)
+	}
+	ts.cache[key] = t
+	return t, nil
+}
+
+// Return the client for the target of request. The redirects are not followed, since the redirected targets are not
+// checked by the allowlist, and the redirect responses are returned to the caller as is.
+func (ts *transports) client(r common.HttpRequest) (*http.Client, error) {
+	t, err := ts.get(r)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: t,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}, nil
+}
+
+// Dial the target of request, the connection is secured by TLS for https targets
+func (ts *transports) dial(r common.HttpRequest, addr string) (net.Conn, error) {
+	t, err := ts.get(r)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil || t.TLSClientConfig == nil {
+		return conn, err
+	}
+	conf := t.TLSClientConfig.Clone()
+	if conf.ServerName == "" {
+		conf.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tc := tls.Client(conn, conf)
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// Create the TLS config to connect the target with the CA bundle and client certificate in agent side
+func newTargetTLSConfig(t common.TargetTls) (*tls.Config, error) {
+	conf := &tls.Config{}
+	if t.CaFile != "" {
+		pool, err := common.LoadCertPool(t.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load certificate %s and key %s: %v", t.CertFile, t.KeyFile, err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	switch t.Mode {
+	case common.TlsInsecure:
+		conf.InsecureSkipVerify = true
+	case common.TlsVerifyCA:
+		// The chain is verified by the callback instead, since the host name cannot be skipped otherwise
+		conf.InsecureSkipVerify = true
+		conf.VerifyPeerCertificate = verifyChain(conf.RootCAs)
+	}
+	return conf, nil
+}
+
+// Verify the certificate chain of the target against the roots without checking the host name
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no certificate is presented by the target")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"bufio"
+	"github.com/emqx/wormhole/common"
+	quic "github.com/lucas-clemente/quic-go"
+	"io"
+	"net"
+	"net/http"
+)
+
+// Send the upgrade request to the local service. If the service switches protocols, the data is spliced between the
+// service and the stream in both directions, otherwise the response is returned as a normal http response.
+func (qcc *QCClient) onUpgrade(stream quic.Stream, cmd *common.HttpCommand) error {
+	req, err := http.NewRequest(cmd.Method, cmd.ToString(), nil)
+	if err != nil {
+		return qcc.writeError(stream, cmd.Sequence, err)
+	}
+	req.Header = cmd.Headers
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		port := "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(req.URL.Hostname(), port)
+	}
+	target, err := qcc.targets.dial(cmd.HttpRequest, addr)
+	if err != nil {
+		return qcc.writeError(stream, cmd.Sequence, err)
+	}
+	defer target.Close()
+	if err := req.Write(target); err != nil {
+		return qcc.writeError(stream, cmd.Sequence, err)
+	}
+	br := bufio.NewReader(target)
+	response, err := http.ReadResponse(br, req)
+	if err != nil {
+		return qcc.writeError(stream, cmd.Sequence, err)
+	}
+	resp := &common.HttpResponse{
+		BasicResponse: common.BasicResponse{
+			ResponseType: common.HTTP_R,
+			Identifier:   qcc.Identifier,
+			Sequence:     cmd.Sequence,
+			Code:         common.OK,
+		},
+		Header:           response.Header,
+		HttpResponseCode: response.StatusCode,
+		HttpResponseText: response.Status,
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		defer response.Body.Close()
+		return qcc.writeResponse(stream, resp, response.Body)
+	}
+
+	go func() {
+		if _, err := io.Copy(target, qcc.newBodyReader(stream)); err != nil {
+			common.Log.Debugf("The upgraded connection to %s is broken: %v", addr, err)
+		}
+		// Both tcp and tls connections can be half closed
+		if cw, ok := target.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+	// The buffered reader may hold the data sent by service right after switching protocols
+	return qcc.writeResponse(stream, resp, br)
+}
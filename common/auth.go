@@ -0,0 +1,92 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The max difference between the timestamp of register command and server time
+const RegisterTimeWindow = 5 * time.Minute
+
+// Generate a random secret for the agent, it's returned once when the agent is created
+func GenerateSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func generateNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Sign the register command with HMAC-SHA256 of the agent secret
+func signRegister(secret string, identifier string, timestamp int64, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%s\n%d\n%s", identifier, timestamp, nonce)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Create a signed register command for the agent
+func NewRegisterCommand(identifier string, secret string) *RegisterCommand {
+	cmd := &RegisterCommand{
+		BasicCommand: BasicCommand{
+			Identifier: identifier,
+			CType:      REGISTER,
+		},
+		Timestamp: time.Now().Unix(),
+		Nonce:     generateNonce(),
+	}
+	cmd.Signature = signRegister(secret, identifier, cmd.Timestamp, cmd.Nonce)
+	return cmd
+}
+
+// The nonces of register commands in the time window, a register command cannot be replayed
+type nonceCache struct {
+	nonces map[string]time.Time
+	mu     sync.Mutex
+}
+
+var usedNonces = &nonceCache{nonces: make(map[string]time.Time)}
+
+func (nc *nonceCache) use(nonce string, now time.Time) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	for n, t := range nc.nonces {
+		if now.Sub(t) > 2*RegisterTimeWindow {
+			delete(nc.nonces, n)
+		}
+	}
+	if _, ok := nc.nonces[nonce]; ok {
+		return false
+	}
+	nc.nonces[nonce] = now
+	return true
+}
+
+// Verify the signature, timestamp and nonce of the register command with the agent secret
+func (c *RegisterCommand) verify(secret string) error {
+	now := time.Now()
+	ts := time.Unix(c.Timestamp, 0)
+	if ts.Before(now.Add(-RegisterTimeWindow)) || ts.After(now.Add(RegisterTimeWindow)) {
+		return fmt.Errorf("the timestamp of register command is out of the time window")
+	}
+	expected := signRegister(secret, c.Identifier, c.Timestamp, c.Nonce)
+	if !hmac.Equal([]byte(expected), []byte(c.Signature)) {
+		return fmt.Errorf("invalid signature")
+	}
+	if c.Nonce == "" || !usedNonces.use(c.Nonce, now) {
+		return fmt.Errorf("the register command is replayed")
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	agentsBucket      = []byte("agents")
+	middlewaresBucket = []byte("middlewares")
+)
+
+// BoltStore keeps the agents and middlewares in an embedded bolt database, so they survive a server restart.
+// The agents are saved in bucket `agents` with identifier as the key, and the middlewares of an agent are saved
+// in a nested bucket of `middlewares` named with the agent identifier.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("The path of bolt store is required")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create the directory for bolt store: %v", err)
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open bolt store %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(agentsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(middlewaresBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to init bolt store %s: %v", path, err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
+
+type BoltAgentManager struct {
+	*BoltStore
+}
+
+func (bm *BoltAgentManager) List() ([]Agent, error) {
+	agents := make([]Agent, 0)
+	err := bm.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(agentsBucket).ForEach(func(k, v []byte) error {
+			n := Agent{}
+			if err := json.Unmarshal(v, &n); err != nil {
+				return fmt.Errorf("Invalid node %s in store: %v", k, err)
+			}
+			agents = append(agents, n)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return agents, nil
+}
+
+func (bm *BoltAgentManager) Add(n Agent) (*Agent, error) {
+	uuid, _ := uuid.NewUUID()
+	n.Identifier = uuid.String()
+	n.Secret = GenerateSecret()
+	if err := bm.put(n); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func (bm *BoltAgentManager) Update(n Agent) (*Agent, error) {
+	if !n.validate() {
+		return nil, fmt.Errorf("Not valid node settings %v", n)
+	}
+	if n.Identifier == "" {
+		return nil, fmt.Errorf("Identifier is expected %v", n)
+	}
+	// The secret is always generated by server, it cannot be changed by the caller
+	if old, err := bm.GetById(n.Identifier); err == nil {
+		n.Secret = old.Secret
+	} else {
+		n.Secret = GenerateSecret()
+	}
+	if err := bm.put(n); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func (bm *BoltAgentManager) put(n Agent) error {
+	v, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return bm.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(agentsBucket).Put([]byte(n.Identifier), v)
+	})
+}
+
+func (bm *BoltAgentManager) DeleteById(id string) error {
+	if id == "" {
+		return fmt.Errorf("id %s cannot be empty", id)
+	}
+	return bm.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(agentsBucket).Delete([]byte(id))
+	})
+}
+
+func (bm *BoltAgentManager) GetById(id string) (*Agent, error) {
+	var n *Agent
+	err := bm.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(agentsBucket).Get([]byte(id))
+		if v == nil {
+			return fmt.Errorf("Cannot find the node with id %s", id)
+		}
+		n = &Agent{}
+		return json.Unmarshal(v, n)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+type BoltMWManager struct {
+	*BoltStore
+}
+
+func (bm *BoltMWManager) List(nodeid string) (Middlewares, error) {
+	mwares := make(Middlewares, 0)
+	err := bm.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(middlewaresBucket).Bucket([]byte(nodeid))
+		if b == nil {
+			return fmt.Errorf("Cannot find middlewares for id %s", nodeid)
+		}
+		return b.ForEach(func(k, v []byte) error {
+			m := Middleware{}
+			if err := json.Unmarshal(v, &m); err != nil {
+				return fmt.Errorf("Invalid middleware %s in store: %v", k, err)
+			}
+			mwares = append(mwares, m)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mwares, nil
+}
+
+func (bm *BoltMWManager) Add(nodeid string, m Middleware) (*Middleware, error) {
+	if !m.validateMiddleware() {
+		return nil, fmt.Errorf("Not valid middleware settings %v", m)
+	}
+	v, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	err = bm.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(middlewaresBucket).CreateBucketIfNotExists([]byte(nodeid))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(m.Name), v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (bm *BoltMWManager) Update(nodeid string, m Middleware) (*Middleware, error) {
+	if !m.validateMiddleware() {
+		return nil, fmt.Errorf("Not valid middleware settings %v", m)
+	}
+	v, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	err = bm.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(middlewaresBucket).Bucket([]byte(nodeid))
+		if b == nil {
+			return fmt.Errorf("Cannot find middlewares for id %s", nodeid)
+		}
+		if b.Get([]byte(m.Name)) == nil {
+			return fmt.Errorf("Cannot find the middleware with name %s", m.Name)
+		}
+		return b.Put([]byte(m.Name), v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (bm *BoltMWManager) DeleteByName(nodeid string, name string) error {
+	if nodeid == "" || name == "" {
+		return fmt.Errorf("nodeid or name cannot be empty ")
+	}
+	return bm.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(middlewaresBucket).Bucket([]byte(nodeid))
+		if b == nil {
+			return fmt.Errorf("Cannot find middlewares for id %s", nodeid)
+		}
+		if b.Get([]byte(name)) == nil {
+			return fmt.Errorf("Cannot find the middleware with name %s", name)
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+func (bm *BoltMWManager) GetByName(nodeid string, name string) (*Middleware, error) {
+	if nodeid == "" || name == "" {
+		return nil, fmt.Errorf("nodeid or name cannot be empty ")
+	}
+	var m *Middleware
+	err := bm.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(middlewaresBucket).Bucket([]byte(nodeid))
+		if b == nil {
+			return fmt.Errorf("Cannot find middlewares for id %s", nodeid)
+		}
+		v := b.Get([]byte(name))
+		if v == nil {
+			return fmt.Errorf("Cannot find the middleware with name %s", name)
+		}
+		m = &Middleware{}
+		return json.Unmarshal(v, m)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,64 @@
+package common
+
+import "fmt"
+
+// The capabilities announced by the agent when registering, the server enables the features supported by both sides
+const (
+	// The request and response bodies are streamed in stream packages
+	CapStreaming = "streaming"
+	// The tcp middlewares
+	CapTcp = "tcp"
+	// The upgrade requests such as websocket
+	CapUpgrade = "upgrade"
+	// The compressed payloads
+	CapCompression = "compression"
+	// The messages encoded with msgpack
+	CapMsgpack = "msgpack"
+	// The ping and pong in control stream
+	CapHeartbeat = "heartbeat"
+	// The trailers of response bodies
+	CapTrailers = "trailers"
+	// The health checking of middlewares by agent
+	CapHealth = "health"
+)
+
+// The capabilities supported by this version
+var SupportedCapabilities = []string{CapStreaming, CapTcp, CapUpgrade, CapCompression, CapMsgpack, CapHeartbeat, CapTrailers, CapHealth}
+
+// The protocol version of this build
+var ProtocolVersion = makeUpVersion(MajorVersion, MinorVersion, FixVersion)
+
+// Return the capabilities supported by both sides, in the order of the local capabilities
+func NegotiateCapabilities(local []string, remote []string) []string {
+	common := make([]string, 0, len(local))
+	for _, l := range local {
+		if HasCapability(remote, l) {
+			common = append(common, l)
+		}
+	}
+	return common
+}
+
+// Whether the capability is in the list
+func HasCapability(caps []string, c string) bool {
+	for _, s := range caps {
+		if s == c {
+			return true
+		}
+	}
+	return false
+}
+
+func VersionString(version uint32) string {
+	major, minor, fix := breadDownVersion(version)
+	return fmt.Sprintf("%d.%d.%d", major, minor, fix)
+}
+
+// Return an error if the peer version cannot talk to this version, only the major version is checked
+func CheckVersion(version uint32) error {
+	major, _, _ := breadDownVersion(version)
+	if major != MajorVersion {
+		return fmt.Errorf("the protocol version %s is incompatible with version %s", VersionString(version), VersionString(ProtocolVersion))
+	}
+	return nil
+}
@@ -1,15 +1,17 @@
 package common
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 )
 
 const (
 	// pakcage version
-	MajorVersion = 1
-	MinorVersion = 1
-	FixVersion   = 1
+	MajorVersion = 2
+	MinorVersion = 0
+	FixVersion   = 0
 )
 
 // make up version
@@ -26,6 +28,7 @@ const (
 	// package type definition
 	Message     PackageType = 0x01
 	Stream      PackageType = 0x02
+	Trailer     PackageType = 0x03
 	UserDefined PackageType = 0x04
 
 	// flags
@@ -57,6 +60,7 @@ type PackageHeader struct {
 	// the package type
 	// message package: 0x01
 	// stream package: 0x02
+	// trailer package: 0x03
 	// user-defined package: 0x04
 	PackageType PackageType
 
@@ -150,7 +154,9 @@ func (h *PackageHeader) Unpack(header []byte) {
 }
 
 type Writer struct {
-	Writer io.Writer
+	Writer      io.Writer
+	compression *Compression
+	encoding    string
 }
 
 // new Writer instance
@@ -158,19 +164,64 @@ func NewWriter(w io.Writer) *Writer {
 	return &Writer{Writer: w}
 }
 
+// New Writer instance which compresses the payloads with the negotiated compression, nil means no compression
+func NewCompressedWriter(w io.Writer, c *Compression) *Writer {
+	return &Writer{Writer: w, compression: c}
+}
+
 // Write message raw data
 // steps:
 // 1) packer the package header
 // 2) write header
 // 3) write message raw data
 func (w *Writer) Write(data []byte) (int, error) {
+	return w.WritePackage(Message, data)
+}
+
+// Set the encoding of messages written by WriteMessage, JSON by default
+func (w *Writer) WithEncoding(encoding string) *Writer {
+	w.encoding = encoding
+	return w
+}
+
+// Write the message with its kind in the package type of header
+func (w *Writer) WriteMessage(m interface{}) error {
+	kind, err := MessageKind(m)
+	if err != nil {
+		return err
+	}
+	data, flags, err := encodeMessage(w.encoding, m)
+	if err != nil {
+		return err
+	}
+	_, err = w.writePackage(kind, flags, data)
+	return err
+}
+
+// Write the raw data as a package of the specified type
+func (w *Writer) WritePackage(packageType PackageType, data []byte) (int, error) {
+	return w.writePackage(packageType, 0, data)
+}
+
+func (w *Writer) writePackage(packageType PackageType, flags uint8, data []byte) (int, error) {
 	if w.Writer == nil {
 		fmt.Println("bad io writer")
 		return 0, fmt.Errorf("bad io writer")
 	}
 
+	// The peer decompresses the payload within the max frame size as well, so the raw size is checked first
+	raw := len(data)
+	if uint32(raw) > maxFrameSize {
+		return 0, newFrameTooLargeError(uint32(raw))
+	}
+	data, compressed := w.compression.compress(data)
+	if uint32(len(data)) > maxFrameSize {
+		return 0, newFrameTooLargeError(uint32(len(data)))
+	}
+
 	// packing header
-	header := NewPackageHeader(Message)
+	header := NewPackageHeader(packageType)
+	header.SetFlags(flags | compressed)
 	header.SetPayloadLen(uint32(len(data)))
 	var headerBuffer []byte
 	header.Pack(&headerBuffer)
@@ -188,26 +239,48 @@ func (w *Writer) Write(data []byte) (int, error) {
 		fmt.Println("failed to write payload")
 		return 0, err
 	}
-	return len(data), nil
+	return raw, nil
 }
 
 type Reader struct {
-	Reader io.Reader
+	Reader      io.Reader
+	compression *Compression
 }
 
 func NewReader(r io.Reader) *Reader {
 	return &Reader{Reader: r}
 }
 
+// New Reader instance which counts the compressed payloads in the compression. The compressed payloads are always
+// decompressed no matter whether the compression is specified.
+func NewCompressedReader(r io.Reader, c *Compression) *Reader {
+	return &Reader{Reader: r, compression: c}
+}
+
 // Read message raw data from reader
 // steps:
 // 1)read the package header
 // 2)unpack the package header and get the payload length
 // 3)read the payload
 func (r *Reader) Read() ([]byte, error) {
+	_, payload, err := r.ReadPackage()
+	return payload, err
+}
+
+// Read a message package and decode it into the concrete type
+func (r *Reader) ReadMessage() (interface{}, error) {
+	header, payload, err := r.ReadPackage()
+	if err != nil {
+		return nil, err
+	}
+	return DecodeMessage(header, payload)
+}
+
+// Read a package from reader, and return the package header together with the payload
+func (r *Reader) ReadPackage() (*PackageHeader, []byte, error) {
 	if r.Reader == nil {
 		fmt.Println("bad io reader")
-		return nil, fmt.Errorf("bad io reader")
+		return nil, nil, fmt.Errorf("bad io reader")
 	}
 
 	headerBuffer := make([]byte, HeaderSize)
@@ -216,11 +289,15 @@ func (r *Reader) Read() ([]byte, error) {
 		if err != io.EOF {
 			fmt.Println("failed to read package header from buffer")
 		}
-		return nil, err
+		return nil, nil, err
 	}
 
 	header := PackageHeader{}
 	header.Unpack(headerBuffer)
+	// Check the length before allocating the buffer, the remaining payload is not consumed
+	if header.PayloadLen > maxFrameSize {
+		return nil, nil, newFrameTooLargeError(header.PayloadLen)
+	}
 
 	payloadBuffer := make([]byte, header.PayloadLen)
 	_, err = io.ReadFull(r.Reader, payloadBuffer)
@@ -228,8 +305,119 @@ func (r *Reader) Read() ([]byte, error) {
 		if err != io.EOF {
 			fmt.Println("failed to read payload from buffer")
 		}
-		return nil, err
+		return nil, nil, err
+	}
+
+	payload, err := decompress(header.Flags, payloadBuffer)
+	if err != nil {
+		if pe := AsProtocolError(err); pe != nil {
+			return nil, nil, pe
+		}
+		return nil, nil, &ProtocolError{Reason: ReasonInvalidPayload, Detail: fmt.Sprintf("failed to decompress payload: %v", err)}
 	}
+	r.compression.count(len(payload), len(payloadBuffer))
+	header.SetPayloadLen(uint32(len(payload)))
+
+	return &header, payload, nil
+}
+
+// The max payload size of a stream package
+const BodyChunkSize = 32 * 1024
+
+// BodyWriter splits the body into stream packages. A stream package with empty payload
+// is written when closing the writer, which marks the end of the body. The trailers of the body can be written as a
+// trailer package before closing the writer.
+type BodyWriter struct {
+	writer *Writer
+}
+
+func NewBodyWriter(w io.Writer) *BodyWriter {
+	return &BodyWriter{writer: NewWriter(w)}
+}
+
+func NewCompressedBodyWriter(w io.Writer, c *Compression) *BodyWriter {
+	return &BodyWriter{writer: NewCompressedWriter(w, c)}
+}
+
+func (bw *BodyWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		size := len(data)
+		if size > BodyChunkSize {
+			size = BodyChunkSize
+		}
+		if _, err := bw.writer.WritePackage(Stream, data[:size]); err != nil {
+			return written, err
+		}
+		written += size
+		data = data[size:]
+	}
+	return written, nil
+}
+
+// Write the trailers of the body in JSON, it must be called after the body is written and before closing the writer
+func (bw *BodyWriter) WriteTrailer(trailer http.Header) error {
+	data, err := json.Marshal(trailer)
+	if err != nil {
+		return err
+	}
+	_, err = bw.writer.WritePackage(Trailer, data)
+	return err
+}
+
+func (bw *BodyWriter) Close() error {
+	_, err := bw.writer.WritePackage(Stream, nil)
+	return err
+}
+
+// BodyReader reads the body written by BodyWriter, it returns io.EOF after reading the end mark.
+type BodyReader struct {
+	reader  *Reader
+	pending []byte
+	eof     bool
+	trailer http.Header
+}
+
+func NewBodyReader(r io.Reader) *BodyReader {
+	return &BodyReader{reader: NewReader(r)}
+}
+
+func NewCompressedBodyReader(r io.Reader, c *Compression) *BodyReader {
+	return &BodyReader{reader: NewCompressedReader(r, c)}
+}
+
+func (br *BodyReader) Read(p []byte) (int, error) {
+	for len(br.pending) == 0 {
+		if br.eof {
+			return 0, io.EOF
+		}
+		header, payload, err := br.reader.ReadPackage()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if header.GetPackageType() == Trailer {
+			if err := json.Unmarshal(payload, &br.trailer); err != nil {
+				return 0, &ProtocolError{Reason: ReasonInvalidPayload, Detail: fmt.Sprintf("failed to decode trailer: %v", err)}
+			}
+			continue
+		}
+		if header.GetPackageType() != Stream {
+			return 0, fmt.Errorf("expect stream package but got package type %d", header.GetPackageType())
+		}
+		if len(payload) == 0 {
+			br.eof = true
+		}
+		br.pending = payload
+	}
+	n := copy(p, br.pending)
+	br.pending = br.pending[n:]
+	return n, nil
+}
 
-	return payloadBuffer, nil
+// The trailers of the body, which are only available after reading the body to io.EOF
+func (br *BodyReader) Trailers() http.Header {
+	return br.trailer
 }
@@ -0,0 +1,38 @@
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestBodyRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), BodyChunkSize/4)
+	trailer := http.Header{"X-Checksum": {"abc"}, "X-Parts": {"1", "2"}}
+
+	var buf bytes.Buffer
+	bw := NewBodyWriter(&buf)
+	if _, err := bw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.WriteTrailer(trailer); err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	br := NewBodyReader(&buf)
+	got, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got body of %d bytes, want %d bytes", len(got), len(data))
+	}
+	if !reflect.DeepEqual(br.Trailers(), trailer) {
+		t.Errorf("got trailers %v, want %v", br.Trailers(), trailer)
+	}
+}
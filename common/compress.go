@@ -0,0 +1,165 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+const (
+	// The low bits of package flags are the codec of compressed payload
+	FlagCodecMask = 0x0F
+)
+
+// Codec compresses the payload of packages, the id is carried in the low bits of flags of compressed packages
+type Codec interface {
+	Name() string
+	ID() uint8
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var codecs = map[string]Codec{}
+var codecsById = map[uint8]Codec{}
+
+func registerCodec(c Codec) {
+	codecs[c.Name()] = c
+	codecsById[c.ID()] = c
+}
+
+func init() {
+	registerCodec(gzipCodec{})
+}
+
+func GetCodec(name string) Codec {
+	return codecs[name]
+}
+
+// Return the first algorithm of the preferred list which is supported by the peer, or empty if there is none
+func NegotiateCompression(preferred []string, supported []string) string {
+	for _, p := range preferred {
+		if GetCodec(p) == nil {
+			continue
+		}
+		for _, s := range supported {
+			if p == s {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) ID() uint8 {
+	return 0x01
+}
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r)
+}
+
+// The decompressed payload is limited by the max frame size as well, to protect against decompression bombs
+func readLimited(r io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, int64(maxFrameSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(b)) > maxFrameSize {
+		return nil, &ProtocolError{
+			Reason: ReasonFrameTooLarge,
+			Detail: fmt.Sprintf("the decompressed payload exceeds the max frame size %d", maxFrameSize),
+		}
+	}
+	return b, nil
+}
+
+// Compression is the negotiated compression of a connection, the payloads larger than the threshold are compressed
+// when writing. It also counts the payload bytes before and after compression in both directions.
+type Compression struct {
+	Codec     Codec
+	Threshold int
+	rawBytes  int64
+	wireBytes int64
+}
+
+func NewCompression(algorithm string, threshold int) *Compression {
+	return &Compression{Codec: GetCodec(algorithm), Threshold: threshold}
+}
+
+func (c *Compression) compress(data []byte) ([]byte, uint8) {
+	if c == nil || c.Codec == nil || len(data) == 0 || len(data) < c.Threshold {
+		c.count(len(data), len(data))
+		return data, 0
+	}
+	compressed, err := c.Codec.Compress(data)
+	if err != nil || len(compressed) >= len(data) {
+		c.count(len(data), len(data))
+		return data, 0
+	}
+	c.count(len(data), len(compressed))
+	return compressed, FlagCompressed | c.Codec.ID()
+}
+
+func (c *Compression) count(raw, wire int) {
+	if c != nil {
+		atomic.AddInt64(&c.rawBytes, int64(raw))
+		atomic.AddInt64(&c.wireBytes, int64(wire))
+	}
+}
+
+// The ratio of payload bytes before and after compression, 1 means nothing is saved
+func (c *Compression) Ratio() float64 {
+	if c == nil {
+		return 1
+	}
+	raw, wire := atomic.LoadInt64(&c.rawBytes), atomic.LoadInt64(&c.wireBytes)
+	if wire == 0 {
+		return 1
+	}
+	return float64(raw) / float64(wire)
+}
+
+func (c *Compression) Algorithm() string {
+	if c == nil || c.Codec == nil {
+		return ""
+	}
+	return c.Codec.Name()
+}
+
+// Decompress the payload according to the flags of package
+func decompress(flags uint8, payload []byte) ([]byte, error) {
+	if flags&FlagCompressed == 0 {
+		return payload, nil
+	}
+	codec := codecsById[flags&FlagCodecMask]
+	if codec == nil {
+		return nil, fmt.Errorf("unknown compression codec %d", flags&FlagCodecMask)
+	}
+	return codec.Decompress(payload)
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"crypto/x509"
 	"fmt"
 	"github.com/go-yaml/yaml"
 	filename "github.com/keepeye/logrus-filename"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"time"
 )
 
 type (
@@ -18,17 +20,103 @@ type (
 		LogPath    string `yaml:"logPath"`
 	}
 
+	TlsConfig struct {
+		CertFile string `yaml:"certFile"`
+		KeyFile  string `yaml:"keyFile"`
+		CaFile   string `yaml:"caFile"`
+		// The server name to verify the server certificate, only used by agent
+		ServerName string `yaml:"serverName"`
+		// Skip the verification of server certificate, only used by agent
+		Insecure bool `yaml:"insecure"`
+		// Whether the common name of client certificate must be the agent identifier, only used by server
+		BindIdentifier bool `yaml:"bindIdentifier"`
+	}
+
+	ApiKeyConfig struct {
+		Key  string `yaml:"key"`
+		Role string `yaml:"role"`
+		// The agents that can be accessed with the key, all agents can be accessed if it's empty
+		Agents []string `yaml:"agents"`
+	}
+
+	AuthConfig struct {
+		Enable  bool           `yaml:"enable"`
+		ApiKeys []ApiKeyConfig `yaml:"apiKeys"`
+		// The HMAC secret to verify JWT bearer tokens, JWT is disabled if it's empty
+		JwtSecret string `yaml:"jwtSecret"`
+	}
+
+	CompressionConfig struct {
+		// The compression algorithms in order of preference, only gzip is supported now. Empty means no compression
+		Algorithms []string `yaml:"algorithms"`
+		// The payloads smaller than the threshold bytes are not compressed, 1024 by default
+		Threshold int `yaml:"threshold"`
+	}
+
+	TracingConfig struct {
+		// Whether to export the spans to the OTLP collector, the trace context is always propagated
+		Enable bool `yaml:"enable"`
+		// The address of OTLP gRPC collector
+		Endpoint string `yaml:"endpoint"`
+		// The ratio of traces to sample if the caller doesn't decide, all traces are sampled by default
+		SampleRatio float64 `yaml:"sampleRatio"`
+	}
+
+	AllowTargetConfig struct {
+		// The type of target, http or tcp, default to http
+		Type string `yaml:"type"`
+		// The host of target, default to 127.0.0.1
+		Host string `yaml:"host"`
+		Port int    `yaml:"port"`
+		// The path prefix and methods allowed for http target, all of them are allowed if it's empty
+		PathPrefix string   `yaml:"pathPrefix"`
+		Methods    []string `yaml:"methods"`
+	}
+
+	StoreConfig struct {
+		Type string `yaml:"type"`
+		Path string `yaml:"path"`
+	}
+
 	ServerConfig struct {
 		Basic struct {
 			BindAddr string `yaml:"bindAddr"`
 			BindPort int    `yaml:"bindPort"`
+			// The address that the ports of tcp middlewares bind to, 127.0.0.1 by default since they are not authenticated
+			ForwardBindAddr string `yaml:"forwardBindAddr"`
+			// The default seconds to wait for the response of a command
+			CommandTimeout int `yaml:"commandTimeout"`
+			// The max seconds to wait that can be requested by the caller through the header, 300 by default
+			MaxCommandTimeout int `yaml:"maxCommandTimeout"`
+			// The seconds between heartbeats, and the count of missed heartbeats in a row to evict the agent
+			HeartbeatInterval int `yaml:"heartbeatInterval"`
+			HeartbeatMisses   int `yaml:"heartbeatMisses"`
+			// The encodings of messages in order of preference, msgpack or json
+			Encodings []string `yaml:"encodings"`
+			// The max payload bytes of a package, 1MB by default
+			MaxFrameSize int `yaml:"maxFrameSize"`
+			// Whether to accept the registration of agents without secret, which are created by older versions
+			AllowAgentsWithoutSecret bool `yaml:"allowAgentsWithoutSecret"`
+			// Whether to forward the tcp services advertised by agents, which open ports in server
+			AllowAgentTcpServices bool `yaml:"allowAgentTcpServices"`
 		}
 		Log  LogConfig
 		Rest struct {
-			RestBindAddr string `yaml:"restBindAddr"`
-			RestBindPort int    `yaml:"restBindPort"`
-			EnableRest   bool   `yaml:"enableRest"`
+			RestBindAddr string     `yaml:"restBindAddr"`
+			RestBindPort int        `yaml:"restBindPort"`
+			EnableRest   bool       `yaml:"enableRest"`
+			Auth         AuthConfig `yaml:"auth"`
+			// The max bytes of request headers, 1MB by default
+			MaxHeaderBytes int `yaml:"maxHeaderBytes"`
+			// The default max bytes of request bodies, which can be overridden by middleware. No limit if it's 0
+			MaxBodySize int64 `yaml:"maxBodySize"`
+			// The max seconds to write a response, no limit if it's 0 so that the streamed responses are not cut
+			WriteTimeout int `yaml:"writeTimeout"`
 		}
+		Store       StoreConfig
+		Tls         TlsConfig
+		Tracing     TracingConfig
+		Compression CompressionConfig
 	}
 
 	AgentConfig struct {
@@ -36,11 +124,42 @@ type (
 			Server  string `yaml:"server"`
 			Port    int    `yaml:"port"`
 			AgentId string `yaml:"agentId"`
+			Secret  string `yaml:"secret"`
+			// The encodings of messages supported by the agent, msgpack or json
+			Encodings []string `yaml:"encodings"`
+			// The max payload bytes of a package, 1MB by default
+			MaxFrameSize int `yaml:"maxFrameSize"`
 		}
 		Log   LogConfig
 		Miscs struct {
 			HttpTimeout int `yaml:"httpTimeout"`
 		}
+		Reconnect struct {
+			InitialInterval int `yaml:"initialInterval"`
+			MaxInterval     int `yaml:"maxInterval"`
+		}
+		Tls     TlsConfig
+		Metrics struct {
+			BindAddr string `yaml:"bindAddr"`
+			// The port to expose metrics, the metrics are not exposed if it's 0
+			Port int `yaml:"port"`
+		}
+		Tracing     TracingConfig
+		Compression CompressionConfig
+		Allowlist   struct {
+			// Whether to refuse the targets not in the allowlist, enabled if not specified. All targets are allowed if
+			// it's disabled explicitly
+			Enable  *bool               `yaml:"enable"`
+			Targets []AllowTargetConfig `yaml:"targets"`
+		}
+		// The local services advertised to server when registering
+		Services []Service `yaml:"services"`
+		Health   struct {
+			// The seconds between the health checks of middlewares, 10 by default. A negative value disables it
+			Interval int `yaml:"interval"`
+			// The seconds to wait for a health check, 3 by default
+			Timeout int `yaml:"timeout"`
+		}
 	}
 )
 
@@ -64,6 +183,54 @@ func GetAgentConf() (*AgentConfig, bool) {
 	return clientConf, clientConf.initClientConfig()
 }
 
+// The default timeout of commands, 10 seconds if it's not configured
+func GetCommandTimeout() time.Duration {
+	if conf, _ := GetSrvConf(); conf.Basic.CommandTimeout > 0 {
+		return time.Duration(conf.Basic.CommandTimeout) * time.Second
+	}
+	return 10 * time.Second
+}
+
+// The address that the forwarded ports of tcp middlewares bind to, the loopback address if it's not configured
+func GetForwardBindAddr() string {
+	if conf, _ := GetSrvConf(); conf.Basic.ForwardBindAddr != "" {
+		return conf.Basic.ForwardBindAddr
+	}
+	return "127.0.0.1"
+}
+
+// The max timeout of commands requested by callers, 5 minutes if it's not configured
+func GetMaxCommandTimeout() time.Duration {
+	if conf, _ := GetSrvConf(); conf.Basic.MaxCommandTimeout > 0 {
+		return time.Duration(conf.Basic.MaxCommandTimeout) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+// The interval of heartbeats and the count of missed heartbeats to evict the agent, 10 seconds and 3 by default.
+// The heartbeat is disabled if the interval is negative.
+func GetHeartbeat() (time.Duration, int) {
+	conf, _ := GetSrvConf()
+	interval, misses := 10*time.Second, 3
+	if conf.Basic.HeartbeatInterval > 0 {
+		interval = time.Duration(conf.Basic.HeartbeatInterval) * time.Second
+	} else if conf.Basic.HeartbeatInterval < 0 {
+		interval = 0
+	}
+	if conf.Basic.HeartbeatMisses > 0 {
+		misses = conf.Basic.HeartbeatMisses
+	}
+	return interval, misses
+}
+
+// The threshold of compression, 1024 bytes by default
+func (conf CompressionConfig) GetThreshold() int {
+	if conf.Threshold > 0 {
+		return conf.Threshold
+	}
+	return 1024
+}
+
 func processPath(path string) (string, error) {
 	if abs, err := filepath.Abs(path); err != nil {
 		return "", nil
@@ -75,8 +242,13 @@ func processPath(path string) (string, error) {
 	}
 }
 
+// The configuration files are loaded from the etc directory, which can be overridden by WORMHOLE_CONF_DIR
 func loadConf(fname string) ([]byte, bool) {
-	var confPath, err = processPath("etc/" + fname)
+	dir := "etc"
+	if d := os.Getenv("WORMHOLE_CONF_DIR"); d != "" {
+		dir = d
+	}
+	var confPath, err = processPath(filepath.Join(dir, fname))
 	content, err := ioutil.ReadFile(confPath)
 	if nil != err {
 		fmt.Println("load conf err : ", err)
@@ -85,6 +257,19 @@ func loadConf(fname string) ([]byte, bool) {
 	return content, true
 }
 
+// Load the PEM encoded certificates in the file as a certificate pool
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA file %s: %v", file, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No valid certificate is found in CA file %s", file)
+	}
+	return pool, nil
+}
+
 func (conf LogConfig) validateLogSettings() bool {
 	var err error
 	if conf.LogPath, err = filepath.Abs(conf.LogPath); nil != err {
@@ -3,11 +3,18 @@ package common
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/lucas-clemente/quic-go"
 	"github.com/sirupsen/logrus"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +24,13 @@ const (
 	ILLEGAL CmdType = iota
 	REGISTER
 	HTTP
+	TCP
+	// The heartbeat sent by server and the echo of agent
+	PING
+	PONG
+	// The health targets sent by server and the health reports of agent
+	HEALTH_TARGETS
+	HEALTH
 )
 
 type ResponseCode int
@@ -25,6 +39,12 @@ const (
 	OK ResponseCode = iota
 	BAD_REQUEST
 	ERROR_FOUND
+	UNAUTHORIZED
+	UNKNOWN_AGENT
+	// The major protocol version of agent is different from the server
+	INCOMPATIBLE_VERSION
+	// The target of command is not in the allowlist of agent
+	FORBIDDEN
 )
 
 type ResponseType int
@@ -51,6 +71,33 @@ type HttpCommand struct {
 	HttpRequest
 }
 
+// The tcp command asks the agent to connect to the target, and then the stream carries the data of the tcp connection
+type TcpCommand struct {
+	BasicCommand
+	Host string
+	Port int
+}
+
+func (c *TcpCommand) Json() []byte {
+	j, _ := json.Marshal(c)
+	return j
+}
+
+// The register command is signed with the agent secret
+type RegisterCommand struct {
+	BasicCommand
+	Timestamp int64
+	Nonce     string
+	Signature string
+	// The compression algorithms and message encodings supported by the agent
+	Compressions []string
+	Encodings    []string
+	// The capabilities of the agent, the registration without capabilities is rejected
+	Capabilities []string
+	// The services advertised by the agent, which are merged into its middlewares
+	Services []Service
+}
+
 func (c *BasicCommand) GetSequence() int {
 	return c.Sequence
 }
@@ -103,12 +150,30 @@ type BasicResponse struct {
 	Description  string
 }
 
+// The response of register command with the negotiated settings of the connection
+type RegisterResponse struct {
+	BasicResponse
+	// The negotiated compression algorithm, empty means no compression
+	Compression string
+	// The negotiated encoding of messages
+	Encoding string
+	// The protocol version of server, and the capabilities enabled for the agent
+	Version      string
+	Capabilities []string
+}
+
+func (r *RegisterResponse) Json() []byte {
+	j, _ := json.Marshal(r)
+	return j
+}
+
 type HttpResponse struct {
 	BasicResponse
 	http.Header
 	HttpResponseCode int
 	HttpResponseText string
-	Body             []byte
+	// The nanoseconds from sending the request to service until the response header arrives, measured by agent
+	UpstreamTime int64
 }
 
 func (r *BasicResponse) GetSequence() int {
@@ -136,170 +201,489 @@ func (r *BasicResponse) Validate() error {
 }
 
 type QuicConnection struct {
+	Identifier    string
 	Session       quic.Session
 	Stream        quic.Stream
 	commandStatus map[int]*commandStatus
 	Cancel        context.CancelFunc
+	// Guard the command status
+	mu sync.Mutex
+	// Serialize the writes to control stream
+	writeMu       sync.Mutex
+	stats         connStats
+	heartbeatOnce sync.Once
+	// The negotiated compression, nil if the client doesn't support compression
+	compression *Compression
+	// The negotiated encoding of messages
+	encoding string
+	// The capabilities supported by both sides
+	capabilities []string
+	// The health of middlewares reported by the client, by middleware name, and the generation of targets sent
+	health           sync.Map
+	healthMu         sync.Mutex
+	healthGeneration int64
+}
+
+func NewQuicConnection(session quic.Session, stream quic.Stream, cancel context.CancelFunc) *QuicConnection {
+	qc := &QuicConnection{
+		Session:       session,
+		commandStatus: make(map[int]*commandStatus),
+		Cancel:        cancel,
+		stats:         connStats{connectedSince: time.Now()},
+	}
+	qc.Stream = &countingStream{Stream: stream, stats: &qc.stats}
+	return qc
 }
 
 type commandStatus struct {
 	status   chan int
 	response Response
-	timeout  int64
-	error    error
+	body     io.ReadCloser
 }
 
-func (cs *commandStatus) start(wg *sync.WaitGroup) {
-	for alive := true; alive; {
-		timeout := time.Duration(cs.timeout) * time.Second
-		timer := time.NewTimer(timeout)
-		select {
-		case <-cs.status:
-			timer.Stop()
-			wg.Done()
-			return
-		case <-timer.C:
-			alive = false
-			Log.Errorf("No response after %d seconds, timeout!", cs.timeout)
-		}
-	}
-}
+// The error returned by SendCommand if there is no response before the deadline of context
+var ErrCommandTimeout = errors.New("no response from the client before timeout")
 
-func newResponse(t interface{}) Response {
-	ct1, _ := t.(float64)
-	t1 := ResponseType(int64(ct1))
-	if t1 == BASIC_R {
-		return &BasicResponse{}
-	} else if t1 == HTTP_R {
-		return &HttpResponse{}
-	}
-	return nil
-}
+// The error returned by SendCommand if the connection is closed before the response arrives
+var ErrConnectionClosed = errors.New("the connection to the client is closed")
 
 func (qc *QuicConnection) ListenToClient() {
 	for {
-		if b, err := NewReader(qc.Stream).Read(); err != nil {
+		header, b, err := qc.newReader(qc.Stream).ReadPackage()
+		if err != nil {
 			Log.Errorf("Error: %v", err)
+			if pe := AsProtocolError(err); pe != nil {
+				// The control stream cannot be recovered, so the connection is closed
+				qc.onProtocolError(pe)
+				qc.Close(pe.Error())
+			}
 			qc.Cancel()
+			if qc.Identifier != "" {
+				GetManager().RemoveConn(qc.Identifier, qc)
+			}
 			break
-		} else {
-			request := map[string]interface{}{}
-			if err := json.Unmarshal(b, &request); err != nil {
-				Log.Errorf("%s\n", fmt.Sprintf("Found error %s when trying to unmarshal data from client %d.", qc.Stream.StreamID()))
+		}
+		m, err := DecodeMessage(header, b)
+		if err != nil {
+			Log.Errorf("Found error %s when trying to decode data from client %d.", err, qc.Stream.StreamID())
+			continue
+		}
+		switch msg := m.(type) {
+		case *RegisterCommand:
+			//Logic for client registration
+			atomic.StoreUint32(&qc.stats.version, header.GetVersion())
+			resp := qc.onRegister(*msg, header.GetVersion())
+			if e := qc.sendResponse(&resp); e != nil {
+				Log.Errorf("Error: %v", e)
+			} else if resp.Code == OK && qc.HasCapability(CapHealth) {
+				qc.sendHealthTargets()
+			}
+		case *HeartbeatCommand:
+			if msg.CType == PONG {
+				qc.onPong(*msg)
 			} else {
-				if code, rt := request["Code"], request["ResponseType"]; code != nil && rt != nil {
-					response := newResponse(rt)
-					if err := json.Unmarshal(b, &response); err != nil {
-						Log.Errorf("It's not a valid command response packet: %v", err)
-					} else {
-						qc.onCommandResponse(response)
-					}
-					continue
-				} else if ct := request["CType"]; ct != nil {
-					//Logic for client registration
-					ct1, _ := ct.(float64)
-					if CmdType(int(ct1)) == REGISTER {
-						cmd := BasicCommand{}
-						e := json.Unmarshal(b, &cmd)
-						if e != nil {
-							Log.Errorf("It's not a valid register command packet: %v", e)
-						}
-						if resp := cmd.Validate(); resp == nil {
-							resp := BasicResponse{
-								Identifier:  cmd.Identifier,
-								Code:        OK,
-								Description: "The client is registered successfully.",
-							}
-							GetManager().AddConn(cmd.Identifier, qc)
-							if e = qc.sendResponse(resp); e != nil {
-								Log.Errorf("Error: %v", e)
-							}
-						} else {
-							if e = qc.sendResponse(*resp); e != nil {
-								Log.Errorf("Error: %v", e)
-							}
-						}
-						continue
-					}
-				}
-				Log.Errorf("Unknown packet %s", b)
+				Log.Errorf("Unexpected command type %d from client %s", msg.CType, qc.Identifier)
 			}
+		case *HealthReport:
+			qc.onHealthReport(*msg)
+		case Response:
+			qc.onCommandResponse(msg, nil)
+		default:
+			Log.Errorf("Unknown packet %s", b)
 		}
 	}
 }
 
-func (qc *QuicConnection) onCommandResponse(response Response) {
-	if e := response.Validate(); e != nil {
-		Log.Errorf("%s", e)
+// Validate the register command, the connection is added into manager if the client is registered successfully
+func (qc *QuicConnection) onRegister(cmd RegisterCommand, version uint32) RegisterResponse {
+	if resp := cmd.Validate(); resp != nil {
+		return RegisterResponse{BasicResponse: *resp}
+	}
+	// Authenticate the agent first, the server version is only told to the authenticated agents
+	if resp := qc.verifyPeerCertificate(cmd.Identifier); resp != nil {
+		return RegisterResponse{BasicResponse: *resp}
+	}
+	if resp := verifyAgentSecret(cmd); resp != nil {
+		return RegisterResponse{BasicResponse: *resp}
+	}
+	// The agents of 1.x don't announce capabilities, they cannot talk to this version even if the version is forged
+	err := CheckVersion(version)
+	if err == nil && len(cmd.Capabilities) == 0 {
+		err = fmt.Errorf("no capabilities are announced")
+	}
+	if err != nil {
+		estr := fmt.Sprintf("The agent %s is rejected: %v.", cmd.Identifier, err)
+		Log.Errorf("%s", estr)
+		return RegisterResponse{
+			BasicResponse: BasicResponse{
+				Identifier:  cmd.Identifier,
+				Code:        INCOMPATIBLE_VERSION,
+				Description: estr,
+			},
+			Version: VersionString(ProtocolVersion),
+		}
+	}
+	qc.capabilities = NegotiateCapabilities(SupportedCapabilities, cmd.Capabilities)
+	conf, _ := GetSrvConf()
+	if qc.HasCapability(CapCompression) {
+		if algorithm := NegotiateCompression(conf.Compression.Algorithms, cmd.Compressions); algorithm != "" {
+			qc.compression = NewCompression(algorithm, conf.Compression.GetThreshold())
+			Log.Infof("The payloads to client %s are compressed with %s.", cmd.Identifier, algorithm)
+		}
+	}
+	qc.encoding = EncodingJSON
+	if qc.HasCapability(CapMsgpack) {
+		qc.encoding = NegotiateEncoding(conf.Basic.Encodings, cmd.Encodings)
+	}
+	Log.Infof("The client %s of version %s is registered with capabilities %v.", cmd.Identifier, VersionString(version), qc.capabilities)
+	qc.Identifier = cmd.Identifier
+	mergeServices(cmd.Identifier, cmd.Services)
+	GetManager().AddConn(cmd.Identifier, qc)
+	if interval, misses := GetHeartbeat(); interval > 0 && qc.HasCapability(CapHeartbeat) {
+		qc.heartbeatOnce.Do(func() {
+			go qc.heartbeat(interval, misses)
+		})
+	}
+	return RegisterResponse{
+		BasicResponse: BasicResponse{
+			Identifier:  cmd.Identifier,
+			Code:        OK,
+			Description: "The client is registered successfully.",
+		},
+		Compression:  qc.compression.Algorithm(),
+		Encoding:     qc.encoding,
+		Version:      VersionString(ProtocolVersion),
+		Capabilities: qc.capabilities,
+	}
+}
+
+// Whether the capability is supported by both the server and the client
+func (qc *QuicConnection) HasCapability(c string) bool {
+	return HasCapability(qc.capabilities, c)
+}
+
+// Return a not empty response if the identifier is required to be bound to the client certificate but doesn't match
+func (qc *QuicConnection) verifyPeerCertificate(identifier string) *BasicResponse {
+	if conf, _ := GetSrvConf(); !conf.Tls.BindIdentifier {
+		return nil
+	}
+	certs := qc.Session.ConnectionState().PeerCertificates
+	if len(certs) == 0 || certs[0].Subject.CommonName != identifier {
+		estr := fmt.Sprintf("The client certificate doesn't match the identifier %s.", identifier)
+		Log.Errorf("%s", estr)
+		return &BasicResponse{
+			Identifier:  identifier,
+			Code:        UNAUTHORIZED,
+			Description: estr,
+		}
+	}
+	return nil
+}
+
+// Return a not empty response if the agent is unknown or the register command is not signed with the agent secret
+func verifyAgentSecret(cmd RegisterCommand) *BasicResponse {
+	agent, err := GetAgentManager().GetById(cmd.Identifier)
+	if err != nil {
+		estr := fmt.Sprintf("The agent %s is unknown.", cmd.Identifier)
+		Log.Errorf("%s", estr)
+		return &BasicResponse{
+			Identifier:  cmd.Identifier,
+			Code:        UNKNOWN_AGENT,
+			Description: estr,
+		}
+	}
+	if agent.Secret == "" {
+		if conf, _ := GetSrvConf(); conf.Basic.AllowAgentsWithoutSecret {
+			Log.Warnf("The agent %s has no secret, the registration is not authenticated.", cmd.Identifier)
+			return nil
+		}
+		estr := fmt.Sprintf("The agent %s has no secret, please recreate it.", cmd.Identifier)
+		Log.Errorf("%s", estr)
+		return &BasicResponse{
+			Identifier:  cmd.Identifier,
+			Code:        UNAUTHORIZED,
+			Description: estr,
+		}
+	}
+	if err := cmd.verify(agent.Secret); err != nil {
+		estr := fmt.Sprintf("Failed to authenticate the agent %s: %v.", cmd.Identifier, err)
+		Log.Errorf("%s", estr)
+		return &BasicResponse{
+			Identifier:  cmd.Identifier,
+			Code:        UNAUTHORIZED,
+			Description: estr,
+		}
+	}
+	return nil
+}
+
+// Read the response of a single command from its dedicated stream, the rest of the stream is the response body
+func (qc *QuicConnection) listenToStream(stream quic.Stream) {
+	m, err := qc.newReader(stream).ReadMessage()
+	if err != nil {
+		Log.Errorf("Found error %s when reading response from stream %d.", err, stream.StreamID())
+		if pe := AsProtocolError(err); pe != nil {
+			qc.onProtocolError(pe)
+			stream.CancelRead(ProtocolErrorCode)
+		} else {
+			stream.CancelRead(0)
+		}
 		return
 	}
-	if status := qc.commandStatus[response.GetSequence()]; status == nil {
-		logrus.Errorf("Cannot find related command status for %d.", response.GetSequence())
+	if response, ok := m.(Response); ok {
+		qc.onCommandResponse(response, NewStreamBody(stream, qc.newBodyReader(stream), qc.onProtocolError))
+	} else {
+		Log.Errorf("Unknown packet %T from stream %d", m, stream.StreamID())
+		stream.CancelRead(0)
+	}
+}
+
+// Count the protocol violation of the client, the offending stream is aborted by the caller
+func (qc *QuicConnection) onProtocolError(pe *ProtocolError) {
+	Log.Errorf("The client %s violates the protocol: %v", qc.Identifier, pe)
+	RecordProtocolError(qc.Identifier, pe.Reason)
+}
+
+func (qc *QuicConnection) onCommandResponse(response Response, body io.ReadCloser) {
+	if e := response.Validate(); e != nil {
+		Log.Errorf("%s", e)
+	} else if qc.deliverResponse(response, body) {
 		return
 	} else {
-		status.response = response
-		status.status <- 1
+		logrus.Errorf("Cannot find related command status for %d.", response.GetSequence())
+	}
+	if body != nil {
+		body.Close()
 	}
 }
 
-func (qc *QuicConnection) SendCommand(cmd Command) (Response, error) {
-	var err1 error
+// Send the command to the agent through a newly opened stream, so that a slow command doesn't block the others.
+// The control stream is reserved for the registration and other control traffic.
+// The body is streamed after the command, and the returned response body must be closed by the caller.
+// If the context is done before the response arrives, the stream is aborted so that the agent cancels the command,
+// and ErrCommandTimeout is returned if the deadline is exceeded.
+func (qc *QuicConnection) SendCommand(ctx context.Context, cmd Command, body io.Reader) (Response, io.ReadCloser, error) {
+	s, err := qc.Session.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to open stream to the client: %v", err)
+	}
+	stream := &countingStream{Stream: s, stats: &qc.stats}
+	atomic.AddInt64(&qc.stats.requests, 1)
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	cs := commandStatus{
-		status:  make(chan int),
-		timeout: 10,
+	cs := &commandStatus{
+		status: make(chan int, 1),
 	}
-	if qc.commandStatus == nil {
-		qc.commandStatus = make(map[int]*commandStatus)
+	qc.mu.Lock()
+	qc.commandStatus[cmd.GetSequence()] = cs
+	qc.mu.Unlock()
+	defer func() {
+		qc.mu.Lock()
+		delete(qc.commandStatus, cmd.GetSequence())
+		qc.mu.Unlock()
+		// No response can be delivered after the status is removed, close the body of the one delivered after giving up
+		select {
+		case <-cs.status:
+			if cs.body != nil {
+				cs.body.Close()
+			}
+		default:
+		}
+	}()
+
+	if err := qc.newWriter(stream).WriteMessage(cmd); err != nil {
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, nil, err
+	}
+	Log.Debugf("The command %s is sent successfully through stream %d", cmd.Json(), stream.StreamID())
+	go writeBody(stream, qc.newBodyWriter(stream), body)
+	go qc.listenToStream(stream)
+	select {
+	case <-cs.status:
+		return cs.response, cs.body, nil
+	case <-qc.Session.Context().Done():
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+		Log.Errorf("The connection to client %s is closed before the response of command %d.", qc.Identifier, cmd.GetSequence())
+		return nil, nil, ErrConnectionClosed
+	case <-ctx.Done():
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+		if ctx.Err() == context.DeadlineExceeded {
+			Log.Errorf("No response of command %d from client %s before timeout!", cmd.GetSequence(), qc.Identifier)
+			return nil, nil, ErrCommandTimeout
+		}
+		return nil, nil, ctx.Err()
 	}
-	qc.commandStatus[cmd.GetSequence()] = &cs
-	go cs.start(&wg)
+}
 
-	j := cmd.Json()
-	if _, err := NewWriter(qc.Stream).Write(j); err != nil {
-		err1 = err
-	} else {
-		Log.Debugf("The command %s is sent successfully", j)
+// Deliver the response to the waiting command and return true, or return false if nobody is waiting for it. The status
+// is removed once it's delivered, so that the response and its body are taken by either the command or the caller.
+func (qc *QuicConnection) deliverResponse(response Response, body io.ReadCloser) bool {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	status := qc.commandStatus[response.GetSequence()]
+	if status == nil {
+		return false
 	}
-	if err1 != nil {
-		wg.Done()
-		return nil, err1
-	} else {
-		wg.Wait()
-		return cs.response, cs.error
+	delete(qc.commandStatus, response.GetSequence())
+	status.response = response
+	status.body = body
+	status.status <- 1
+	return true
+}
+
+// Stream the body to the peer, and then close the write direction of the stream
+func writeBody(stream quic.Stream, bw *BodyWriter, body io.Reader) {
+	defer stream.Close()
+	if body != nil {
+		if _, err := io.Copy(bw, body); err != nil {
+			Log.Errorf("Failed to send body through stream %d: %v", stream.StreamID(), err)
+			stream.CancelWrite(0)
+			return
+		}
+	}
+	if err := bw.Close(); err != nil {
+		Log.Errorf("Failed to finish body of stream %d: %v", stream.StreamID(), err)
 	}
 }
 
-func (qc *QuicConnection) sendResponse(resp BasicResponse) error {
-	j := resp.Json()
-	if l, err := NewWriter(qc.Stream).Write(j); err != nil {
+// Close the connection and the underlying session
+func (qc *QuicConnection) Close(reason string) {
+	if qc.Cancel != nil {
+		qc.Cancel()
+	}
+	qc.Session.CloseWithError(0, reason)
+}
+
+func (qc *QuicConnection) sendResponse(resp Response) error {
+	if err := qc.writeControl(resp); err != nil {
 		return err
-	} else {
-		Log.Debugf("The response %s is issued successfully with len %d", j, l)
 	}
+	Log.Debugf("The response %s is issued successfully", resp.Json())
 	return nil
 }
 
-type QConnectionManager map[string]*QuicConnection
+// Write the message to the control stream, the writes from different goroutines are serialized
+func (qc *QuicConnection) writeControl(m interface{}) error {
+	qc.writeMu.Lock()
+	defer qc.writeMu.Unlock()
+	return qc.newWriter(qc.Stream).WriteMessage(m)
+}
 
-var qm QConnectionManager = make(map[string]*QuicConnection)
+// The writers and readers of the connection, with the negotiated compression and encoding
+func (qc *QuicConnection) newWriter(w io.Writer) *Writer {
+	return NewCompressedWriter(w, qc.compression).WithEncoding(qc.encoding)
+}
+
+func (qc *QuicConnection) newReader(r io.Reader) *Reader {
+	return NewCompressedReader(r, qc.compression)
+}
+
+func (qc *QuicConnection) newBodyWriter(w io.Writer) *BodyWriter {
+	return NewCompressedBodyWriter(w, qc.compression)
+}
 
-func GetManager() QConnectionManager {
+func (qc *QuicConnection) newBodyReader(r io.Reader) *BodyReader {
+	return NewCompressedBodyReader(r, qc.compression)
+}
+
+type ConnEventType int
+
+const (
+	// A client is registered
+	CONNECTED ConnEventType = iota
+	// The connection of a client is closed
+	DISCONNECTED
+	// A client is registered again, and the stale connection is replaced
+	REPLACED
+)
+
+type ConnEvent struct {
+	Type       ConnEventType
+	Identifier string
+	// The new connection for CONNECTED and REPLACED, or the closed connection for DISCONNECTED
+	Conn *QuicConnection
+	// The stale connection for REPLACED
+	Old *QuicConnection
+}
+
+// QConnectionManager is the registry of connections of the registered clients, it's safe for concurrent use.
+type QConnectionManager struct {
+	conns       map[string]*QuicConnection
+	subscribers []func(ConnEvent)
+	mu          sync.RWMutex
+}
+
+var qm = &QConnectionManager{conns: make(map[string]*QuicConnection)}
+
+func GetManager() *QConnectionManager {
 	return qm
 }
 
-func (qcm QConnectionManager) AddConn(id string, qc *QuicConnection) {
-	qcm[id] = qc
+// Subscribe the lifecycle events of connections. The subscribers are called in order in the goroutine which changes
+// the connection, so they should return quickly.
+func (qcm *QConnectionManager) Subscribe(f func(ConnEvent)) {
+	qcm.mu.Lock()
+	defer qcm.mu.Unlock()
+	qcm.subscribers = append(qcm.subscribers, f)
+}
+
+func (qcm *QConnectionManager) publish(e ConnEvent) {
+	qcm.mu.RLock()
+	subscribers := qcm.subscribers
+	qcm.mu.RUnlock()
+	for _, f := range subscribers {
+		f(e)
+	}
+}
+
+// Add the connection of the client, the stale connection of a reconnected client is closed
+func (qcm *QConnectionManager) AddConn(id string, qc *QuicConnection) {
+	qcm.mu.Lock()
+	old := qcm.conns[id]
+	qcm.conns[id] = qc
+	qcm.mu.Unlock()
+	if old != nil && old != qc {
+		Log.Infof("The client %s is reconnected from %s, close the stale connection from %s.", id, qc.Session.RemoteAddr(), old.Session.RemoteAddr())
+		old.Close("replaced by a new connection")
+		qcm.publish(ConnEvent{Type: REPLACED, Identifier: id, Conn: qc, Old: old})
+	} else if old == nil {
+		Log.Infof("The client %s is connected from %s.", id, qc.Session.RemoteAddr())
+		qcm.publish(ConnEvent{Type: CONNECTED, Identifier: id, Conn: qc})
+	}
+}
+
+// Remove the connection of the client if it's still the current connection of the client, and return whether it's removed
+func (qcm *QConnectionManager) RemoveConn(id string, qc *QuicConnection) bool {
+	qcm.mu.Lock()
+	removed := qcm.conns[id] == qc
+	if removed {
+		delete(qcm.conns, id)
+	}
+	qcm.mu.Unlock()
+	if removed {
+		Log.Infof("The client %s is disconnected.", id)
+		qcm.publish(ConnEvent{Type: DISCONNECTED, Identifier: id, Conn: qc})
+	}
+	return removed
 }
 
-func (qcm QConnectionManager) RemoveConn(id string) {
-	delete(qcm, id)
+func (qcm *QConnectionManager) GetConn(id string) *QuicConnection {
+	qcm.mu.RLock()
+	defer qcm.mu.RUnlock()
+	return qcm.conns[id]
 }
 
-func (qcm QConnectionManager) GetConn(id string) *QuicConnection {
-	return qcm[id]
+// Return the connections of all the registered clients
+func (qcm *QConnectionManager) List() []*QuicConnection {
+	qcm.mu.RLock()
+	defer qcm.mu.RUnlock()
+	conns := make([]*QuicConnection, 0, len(qcm.conns))
+	for _, qc := range qcm.conns {
+		conns = append(conns, qc)
+	}
+	return conns
 }
 
 type sequenceIDGenerator struct {
@@ -321,14 +705,35 @@ func GetNextId() int {
 }
 
 type HttpRequest struct {
-	Schema   string
-	Method   string
-	Host     string
-	Port     int
+	Schema string
+	Method string
+	Host   string
+	Port   int
+	// The base path of middleware, and the escaped path relative to it
 	BasePath string
 	Path     string
+	// The encoded query without '?'
+	RawQuery string
 	Headers  http.Header
-	Body     []byte
+	// The TLS settings of https target
+	Tls *TargetTls
+	// The length of request body, -1 means unknown. The body itself is streamed after the command.
+	ContentLength int64
+}
+
+// Whether the request asks to switch protocols, such as websocket
+func IsUpgradeRequest(h http.Header) bool {
+	if h.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range h["Connection"] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (request *HttpRequest) ToString() string {
@@ -338,13 +743,34 @@ func (request *HttpRequest) ToString() string {
 	}
 	schema := "http"
 	if request.Schema != "" {
-		schema = schema
+		schema = request.Schema
 	}
-	port := 80
-	if request.Port != 80 {
-		port = request.Port
-		return fmt.Sprintf("%s://%s:%d/%s", schema, host, port, request.Path)
-	} else {
-		return fmt.Sprintf("%s://%s/%s", schema, host, request.Path)
+	if request.Port != 0 && request.Port != defaultPort(schema) {
+		host = net.JoinHostPort(host, strconv.Itoa(request.Port))
+	}
+	u := fmt.Sprintf("%s://%s%s", schema, host, request.joinPath())
+	if request.RawQuery != "" {
+		u += "?" + request.RawQuery
+	}
+	return u
+}
+
+// Join the escaped path to the base path of middleware, the base path is escaped so that it cannot introduce
+// a query or fragment
+func (request *HttpRequest) joinPath() string {
+	base := (&url.URL{Path: request.BasePath}).EscapedPath()
+	if !strings.HasPrefix(base, "/") {
+		base = "/" + base
+	}
+	if request.Path == "" {
+		return base
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(request.Path, "/")
+}
+
+func defaultPort(schema string) int {
+	if schema == "https" {
+		return 443
 	}
+	return 80
 }
@@ -0,0 +1,32 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestHttpRequestToString(t *testing.T) {
+	tests := []struct {
+		name string
+		req  HttpRequest
+		want string
+	}{
+		{"defaults", HttpRequest{Port: 9081, BasePath: "/"}, "http://127.0.0.1:9081/"},
+		{"default http port", HttpRequest{Host: "kuiper", Port: 80, BasePath: "/"}, "http://kuiper/"},
+		{"default https port", HttpRequest{Schema: "https", Host: "camera", Port: 443, BasePath: "/"}, "https://camera/"},
+		{"https on http port", HttpRequest{Schema: "https", Host: "camera", Port: 80, BasePath: "/"}, "https://camera:80/"},
+		{"ipv6 host", HttpRequest{Host: "::1", Port: 8080, BasePath: "/"}, "http://[::1]:8080/"},
+		{"base path kept without path", HttpRequest{Port: 9081, BasePath: "/api/"}, "http://127.0.0.1:9081/api/"},
+		{"base path joined", HttpRequest{Port: 9081, BasePath: "/api/", Path: "streams/demo"}, "http://127.0.0.1:9081/api/streams/demo"},
+		{"base path without slashes", HttpRequest{Port: 9081, BasePath: "api", Path: "/streams"}, "http://127.0.0.1:9081/api/streams"},
+		{"base path escaped", HttpRequest{Port: 9081, BasePath: "/a b?c#d", Path: "x"}, "http://127.0.0.1:9081/a%20b%3Fc%23d/x"},
+		{"escaped path kept", HttpRequest{Port: 9081, BasePath: "/", Path: "a%2Fb/c%23d"}, "http://127.0.0.1:9081/a%2Fb/c%23d"},
+		{"query", HttpRequest{Port: 9081, BasePath: "/", Path: "rules", RawQuery: "a=1&a=2&b=%2F"}, "http://127.0.0.1:9081/rules?a=1&a=2&b=%2F"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.req.ToString(); got != tt.want {
+				t.Errorf("ToString() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
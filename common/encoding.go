@@ -0,0 +1,172 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+const (
+	// The message kinds carried in the package type of header, so that the message is decoded into the concrete type
+	// directly. The messages of package type Message are JSON without kind, which are sent by legacy peers.
+	KindRegister         PackageType = 0x10
+	KindHttp             PackageType = 0x11
+	KindTcp              PackageType = 0x12
+	KindPing             PackageType = 0x13
+	KindPong             PackageType = 0x14
+	KindHealthTargets    PackageType = 0x15
+	KindHealthReport     PackageType = 0x16
+	KindBasicResponse    PackageType = 0x20
+	KindHttpResponse     PackageType = 0x21
+	KindRegisterResponse PackageType = 0x22
+
+	// The payload of message is encoded with msgpack, otherwise it's JSON
+	FlagMsgpack = 0x40
+
+	EncodingJSON    = "json"
+	EncodingMsgpack = "msgpack"
+)
+
+var supportedEncodings = []string{EncodingMsgpack, EncodingJSON}
+
+// Return the first encoding of the preferred list which is supported by the peer, JSON is the fallback
+func NegotiateEncoding(preferred []string, supported []string) string {
+	for _, p := range preferred {
+		for _, s := range supported {
+			if p == s && isSupportedEncoding(p) {
+				return p
+			}
+		}
+	}
+	return EncodingJSON
+}
+
+func isSupportedEncoding(encoding string) bool {
+	for _, e := range supportedEncodings {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the kind of the message
+func MessageKind(m interface{}) (PackageType, error) {
+	switch v := m.(type) {
+	case *RegisterCommand:
+		return KindRegister, nil
+	case *HttpCommand:
+		return KindHttp, nil
+	case *TcpCommand:
+		return KindTcp, nil
+	case *HeartbeatCommand:
+		if v.CType == PONG {
+			return KindPong, nil
+		}
+		return KindPing, nil
+	case *HealthTargetsCommand:
+		return KindHealthTargets, nil
+	case *HealthReport:
+		return KindHealthReport, nil
+	case *BasicResponse:
+		return KindBasicResponse, nil
+	case *HttpResponse:
+		return KindHttpResponse, nil
+	case *RegisterResponse:
+		return KindRegisterResponse, nil
+	}
+	return 0, fmt.Errorf("unknown message type %T", m)
+}
+
+func newMessage(kind PackageType) interface{} {
+	switch kind {
+	case KindRegister:
+		return &RegisterCommand{}
+	case KindHttp:
+		return &HttpCommand{}
+	case KindTcp:
+		return &TcpCommand{}
+	case KindPing, KindPong:
+		return &HeartbeatCommand{}
+	case KindHealthTargets:
+		return &HealthTargetsCommand{}
+	case KindHealthReport:
+		return &HealthReport{}
+	case KindBasicResponse:
+		return &BasicResponse{}
+	case KindHttpResponse:
+		return &HttpResponse{}
+	case KindRegisterResponse:
+		return &RegisterResponse{}
+	}
+	return nil
+}
+
+func encodeMessage(encoding string, m interface{}) ([]byte, uint8, error) {
+	if encoding == EncodingMsgpack {
+		b, err := msgpack.Marshal(m)
+		return b, FlagMsgpack, err
+	}
+	b, err := json.Marshal(m)
+	return b, 0, err
+}
+
+// Decode the payload of a message package into the concrete type according to the kind in header
+func DecodeMessage(header *PackageHeader, payload []byte) (interface{}, error) {
+	kind := header.GetPackageType()
+	if kind == Message {
+		return decodeLegacyMessage(payload)
+	}
+	m := newMessage(kind)
+	if m == nil {
+		return nil, fmt.Errorf("unknown message kind 0x%x", kind)
+	}
+	var err error
+	if header.GetFlags()&FlagMsgpack != 0 {
+		err = msgpack.Unmarshal(payload, m)
+	} else {
+		err = json.Unmarshal(payload, m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid message of kind 0x%x: %v", kind, err)
+	}
+	return m, nil
+}
+
+// The legacy message is JSON without kind, the kind is sniffed from the keys
+func decodeLegacyMessage(payload []byte) (interface{}, error) {
+	sniff := struct {
+		Code         *ResponseCode
+		ResponseType *ResponseType
+		CType        *CmdType
+	}{}
+	if err := json.Unmarshal(payload, &sniff); err != nil {
+		return nil, err
+	}
+	var m interface{}
+	if sniff.Code != nil && sniff.ResponseType != nil {
+		if *sniff.ResponseType == HTTP_R {
+			m = &HttpResponse{}
+		} else {
+			m = &BasicResponse{}
+		}
+	} else if sniff.CType != nil {
+		switch *sniff.CType {
+		case REGISTER:
+			m = &RegisterCommand{}
+		case HTTP:
+			m = &HttpCommand{}
+		case TCP:
+			m = &TcpCommand{}
+		case PING, PONG:
+			m = &HeartbeatCommand{}
+		}
+	}
+	if m == nil {
+		return nil, fmt.Errorf("unknown packet %s", payload)
+	}
+	if err := json.Unmarshal(payload, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
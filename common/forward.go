@@ -0,0 +1,149 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// The forwarder listens at a server side port for a tcp middleware, and every accepted connection is piped to the
+// target in agent side through its own stream.
+type forwarder struct {
+	nodeid   string
+	mware    Middleware
+	listener net.Listener
+}
+
+type forwarders struct {
+	bindAddr string
+	items    map[string]*forwarder
+	mu       sync.Mutex
+}
+
+var fwds = &forwarders{items: make(map[string]*forwarder)}
+
+func forwardKey(nodeid string, name string) string {
+	return nodeid + "/" + name
+}
+
+// Start the forwarders of all the stored tcp middlewares, the listeners bind to the specified address
+func InitForwards(bindAddr string) error {
+	fwds.bindAddr = bindAddr
+	nodes, err := GetAgentManager().List()
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		mws, err := GetMiddlewareManager().List(n.Identifier)
+		if err != nil {
+			continue
+		}
+		for _, mw := range mws {
+			if !mw.IsTCP() {
+				continue
+			}
+			if err := StartForward(n.Identifier, &mw); err != nil {
+				Log.Errorf("Failed to start forward for middleware %s of node %s: %v", mw.Name, n.Identifier, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Start listening for the tcp middleware, the ListenPort is set to the allocated port if it's 0
+func StartForward(nodeid string, mw *Middleware) error {
+	fwds.mu.Lock()
+	defer fwds.mu.Unlock()
+	key := forwardKey(nodeid, mw.Name)
+	if _, ok := fwds.items[key]; ok {
+		return fmt.Errorf("The forward for middleware %s of node %s is already started", mw.Name, nodeid)
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", fwds.bindAddr, mw.ListenPort))
+	if err != nil {
+		return fmt.Errorf("Failed to listen for middleware %s: %v", mw.Name, err)
+	}
+	mw.ListenPort = l.Addr().(*net.TCPAddr).Port
+	f := &forwarder{nodeid: nodeid, mware: *mw, listener: l}
+	fwds.items[key] = f
+	go f.serve()
+	Log.Infof("Forward %s to %s:%d of node %s", l.Addr(), mw.Host, mw.Port, nodeid)
+	return nil
+}
+
+// Stop listening for the tcp middleware, the connections already accepted are not affected
+func StopForward(nodeid string, name string) {
+	fwds.mu.Lock()
+	defer fwds.mu.Unlock()
+	key := forwardKey(nodeid, name)
+	if f, ok := fwds.items[key]; ok {
+		f.listener.Close()
+		delete(fwds.items, key)
+	}
+}
+
+func (f *forwarder) serve() {
+	for {
+		c, err := f.listener.Accept()
+		if err != nil {
+			Log.Infof("Stop forward at %s: %v", f.listener.Addr(), err)
+			return
+		}
+		go f.handle(c)
+	}
+}
+
+func (f *forwarder) handle(c net.Conn) {
+	defer c.Close()
+	conn := GetManager().GetConn(f.nodeid)
+	if conn == nil {
+		Log.Errorf("The connection to node %s is not existed, close the connection from %s.", f.nodeid, c.RemoteAddr())
+		return
+	}
+	if !conn.HasCapability(CapTcp) {
+		Log.Errorf("The node %s doesn't support tcp forwarding, close the connection from %s.", f.nodeid, c.RemoteAddr())
+		return
+	}
+	if h := GetMiddlewareHealth(f.nodeid, f.mware.Name); h.Status == HealthDown {
+		Log.Errorf("The middleware %s of node %s is down, close the connection from %s.", f.mware.Name, f.nodeid, c.RemoteAddr())
+		return
+	}
+	cmd := TcpCommand{
+		BasicCommand: BasicCommand{
+			Identifier: f.nodeid,
+			Sequence:   GetNextId(),
+			CType:      TCP,
+		},
+		Host: f.mware.Host,
+		Port: f.mware.Port,
+	}
+	agent, _ := GetAgentManager().GetById(f.nodeid)
+	ctx, cancel := context.WithTimeout(context.Background(), CommandTimeout(agent, &f.mware))
+	defer cancel()
+	done := TrackRequest(f.nodeid, f.mware.Name)
+	defer done("error")
+	resp, body, err := conn.SendCommand(ctx, &cmd, c)
+	if body != nil {
+		defer body.Close()
+	}
+	if err != nil {
+		if err == ErrCommandTimeout {
+			RecordTimeout(f.nodeid, f.mware.Name)
+		}
+		Log.Errorf("Found error %s when trying to issue command to node %s.", err, f.nodeid)
+		return
+	}
+	if resp == nil {
+		Log.Errorf("No response of command for node %s.", f.nodeid)
+		return
+	}
+	if resp.GetResponseCode() != OK {
+		Log.Errorf("Failed to connect to %s:%d of node %s: %s", f.mware.Host, f.mware.Port, f.nodeid, resp.GetDescription())
+		return
+	}
+	done("ok")
+	if _, err := io.Copy(c, body); err != nil {
+		Log.Debugf("The forward from %s to node %s is broken: %v", c.RemoteAddr(), f.nodeid, err)
+	}
+}
@@ -0,0 +1,134 @@
+package common
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	// The health status of middlewares, it's unknown if the agent is offline or doesn't check the health
+	HealthUp      = "up"
+	HealthDown    = "down"
+	HealthUnknown = "unknown"
+)
+
+// The target to check the health of a middleware. The http path is requested if it's set, otherwise the tcp
+// connection to the target is checked.
+type HealthTarget struct {
+	Name   string
+	Scheme string
+	Host   string
+	Port   int
+	Path   string
+	Tls    *TargetTls
+}
+
+// The command sent by server through the control stream with the health targets of all the middlewares of agent,
+// which replace the previous ones. It's sent after registering and whenever the middlewares are changed.
+type HealthTargetsCommand struct {
+	BasicCommand
+	// The generation of targets, which increases every time the targets are sent through the connection
+	Generation int64
+	Targets    []HealthTarget
+}
+
+func (c *HealthTargetsCommand) Json() []byte {
+	j, _ := json.Marshal(c)
+	return j
+}
+
+// The report sent by agent through the control stream once the health of a middleware is checked for the first
+// time or changed
+type HealthReport struct {
+	BasicCommand
+	// The generation of targets which the checked target belongs to
+	Generation int64
+	Name       string
+	Healthy    bool
+	Detail     string
+}
+
+func (c *HealthReport) Json() []byte {
+	j, _ := json.Marshal(c)
+	return j
+}
+
+// The health of a middleware reported by agent
+type MiddlewareHealth struct {
+	Status string `json:"status"`
+	// The reason of the down status, such as the dial error
+	Detail string `json:"detail,omitempty"`
+	// When the status is changed
+	Since time.Time `json:"since,omitempty"`
+}
+
+func newHealthTarget(mw Middleware) HealthTarget {
+	t := HealthTarget{Name: mw.Name, Host: mw.Host, Port: mw.Port}
+	if !mw.IsTCP() {
+		t.Scheme, t.Path, t.Tls = mw.Scheme, mw.HealthCheck, mw.Tls
+	}
+	return t
+}
+
+// Send the health targets to the agent if it's online and supports health checking
+func SyncHealthTargets(nodeid string) {
+	if conn := GetManager().GetConn(nodeid); conn != nil && conn.HasCapability(CapHealth) {
+		conn.sendHealthTargets()
+	}
+}
+
+func (qc *QuicConnection) sendHealthTargets() {
+	mws, _ := GetMiddlewareManager().List(qc.Identifier)
+	cmd := &HealthTargetsCommand{
+		BasicCommand: BasicCommand{Identifier: qc.Identifier, Sequence: GetNextId(), CType: HEALTH_TARGETS},
+		Targets:      make([]HealthTarget, 0, len(mws)),
+	}
+	for _, mw := range mws {
+		cmd.Targets = append(cmd.Targets, newHealthTarget(mw))
+	}
+	// The targets may be changed, so the health is unknown until the agent reports it again. The reports of previous
+	// generations are dropped, since they may be in flight when clearing.
+	qc.healthMu.Lock()
+	qc.healthGeneration++
+	cmd.Generation = qc.healthGeneration
+	qc.health.Range(func(k, _ interface{}) bool {
+		qc.health.Delete(k)
+		return true
+	})
+	qc.healthMu.Unlock()
+	if err := qc.writeControl(cmd); err != nil {
+		Log.Errorf("Failed to send health targets to client %s: %v", qc.Identifier, err)
+	}
+}
+
+func (qc *QuicConnection) onHealthReport(report HealthReport) {
+	h := MiddlewareHealth{Status: HealthDown, Detail: report.Detail, Since: time.Now()}
+	if report.Healthy {
+		h.Status = HealthUp
+	}
+	qc.healthMu.Lock()
+	stale := report.Generation != qc.healthGeneration
+	if !stale {
+		qc.health.Store(report.Name, h)
+	}
+	qc.healthMu.Unlock()
+	if stale {
+		Log.Debugf("Drop the stale health report of middleware %s of client %s.", report.Name, qc.Identifier)
+		return
+	}
+	if report.Healthy {
+		Log.Infof("The middleware %s of client %s is up.", report.Name, qc.Identifier)
+	} else {
+		Log.Warnf("The middleware %s of client %s is down: %s", report.Name, qc.Identifier, report.Detail)
+	}
+}
+
+// Return the health of the middleware, which is unknown if the agent is offline or hasn't reported it
+func GetMiddlewareHealth(nodeid string, name string) MiddlewareHealth {
+	if conn := GetManager().GetConn(nodeid); conn != nil {
+		if h, ok := conn.health.Load(name); ok {
+			return h.(MiddlewareHealth)
+		}
+	}
+	return MiddlewareHealth{Status: HealthUnknown}
+}
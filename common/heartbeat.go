@@ -0,0 +1,57 @@
+package common
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// The heartbeat command, the server sends it with CType PING through the control stream periodically and the agent
+// echoes it back with CType PONG. The round trip time is measured with the timestamp.
+type HeartbeatCommand struct {
+	BasicCommand
+	// The unix nano when the ping is sent
+	Timestamp int64
+}
+
+func (c *HeartbeatCommand) Json() []byte {
+	j, _ := json.Marshal(c)
+	return j
+}
+
+// Keep sending pings to the client until the connection is closed, the client is evicted if the pongs of
+// maxMisses pings in a row are missed
+func (qc *QuicConnection) heartbeat(interval time.Duration, maxMisses int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-qc.Session.Context().Done():
+			return
+		case <-ticker.C:
+			if misses := atomic.LoadInt32(&qc.stats.misses); int(misses) >= maxMisses {
+				Log.Errorf("The client %s missed %d heartbeats, evict it.", qc.Identifier, misses)
+				qc.Close("heartbeat timeout")
+				GetManager().RemoveConn(qc.Identifier, qc)
+				return
+			}
+			atomic.AddInt32(&qc.stats.misses, 1)
+			ping := &HeartbeatCommand{
+				BasicCommand: BasicCommand{Identifier: qc.Identifier, Sequence: GetNextId(), CType: PING},
+				Timestamp:    time.Now().UnixNano(),
+			}
+			if err := qc.writeControl(ping); err != nil {
+				Log.Errorf("Failed to send heartbeat to client %s: %v", qc.Identifier, err)
+			}
+		}
+	}
+}
+
+func (qc *QuicConnection) onPong(cmd HeartbeatCommand) {
+	now := time.Now().UnixNano()
+	if cmd.Timestamp > 0 && cmd.Timestamp <= now {
+		atomic.StoreInt64(&qc.stats.rtt, now-cmd.Timestamp)
+	}
+	atomic.StoreInt64(&qc.stats.lastHeartbeat, now)
+	atomic.StoreInt32(&qc.stats.misses, 0)
+}
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lucas-clemente/quic-go"
+)
+
+const (
+	// The default max payload size of a package
+	DefaultMaxFrameSize = 1024 * 1024
+	// The min max payload size of a package, the body chunks must fit in a package
+	MinMaxFrameSize = 2 * BodyChunkSize
+
+	// The reasons of protocol errors
+	ReasonFrameTooLarge  = "frame_too_large"
+	ReasonInvalidPayload = "invalid_payload"
+
+	// The application error code to abort the stream on which the peer violates the protocol
+	ProtocolErrorCode quic.ErrorCode = 0x1
+)
+
+var maxFrameSize uint32 = DefaultMaxFrameSize
+
+// Set the max payload size of the packages read and written, the default size is used if it's not positive
+func SetMaxFrameSize(size int) {
+	switch {
+	case size <= 0:
+		size = DefaultMaxFrameSize
+	case size < MinMaxFrameSize:
+		Log.Warnf("The max frame size %d is too small, use %d instead.", size, MinMaxFrameSize)
+		size = MinMaxFrameSize
+	}
+	maxFrameSize = uint32(size)
+}
+
+func MaxFrameSize() int {
+	return int(maxFrameSize)
+}
+
+// ProtocolError is returned when the peer violates the framing protocol. The stream cannot be recovered from it, and
+// it must be closed by the caller.
+type ProtocolError struct {
+	Reason string
+	Detail string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("protocol error (%s): %s", e.Reason, e.Detail)
+}
+
+func newFrameTooLargeError(size uint32) *ProtocolError {
+	return &ProtocolError{
+		Reason: ReasonFrameTooLarge,
+		Detail: fmt.Sprintf("the payload of %d bytes exceeds the max frame size %d", size, maxFrameSize),
+	}
+}
+
+// Return the protocol error in the chain of err, or nil if it's not a protocol error
+func AsProtocolError(err error) *ProtocolError {
+	var pe *ProtocolError
+	if errors.As(err, &pe) {
+		return pe
+	}
+	return nil
+}
+
+// StreamBody reads the body from the stream. The reading direction of the stream is aborted with ProtocolErrorCode
+// once the peer violates the protocol, and the violation is reported to onError.
+type StreamBody struct {
+	*BodyReader
+	stream  quic.Stream
+	onError func(*ProtocolError)
+}
+
+func NewStreamBody(stream quic.Stream, br *BodyReader, onError func(*ProtocolError)) *StreamBody {
+	return &StreamBody{BodyReader: br, stream: stream, onError: onError}
+}
+
+func (sb *StreamBody) Read(p []byte) (int, error) {
+	n, err := sb.BodyReader.Read(p)
+	if pe := AsProtocolError(err); pe != nil {
+		sb.stream.CancelRead(ProtocolErrorCode)
+		if sb.onError != nil {
+			sb.onError(pe)
+		}
+	}
+	return n, err
+}
+
+// Closing the body releases the stream
+func (sb *StreamBody) Close() error {
+	sb.stream.CancelRead(0)
+	return nil
+}
@@ -0,0 +1,130 @@
+package common
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync/atomic"
+	"time"
+)
+
+const metricsNamespace = "wormhole"
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "The count of requests proxied to the agents by status code, the code is ok or error for tcp middlewares.",
+	}, []string{"agent", "middleware", "code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "The latency of the requests proxied to the agents until the response header arrives.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"agent", "middleware"})
+	inflightRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "inflight_requests",
+		Help:      "The count of requests waiting for the response of agents.",
+	}, []string{"agent", "middleware"})
+	timeoutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "timeouts_total",
+		Help:      "The count of requests without response from the agents before timeout.",
+	}, []string{"agent", "middleware"})
+	connectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "agent_connections_total",
+		Help:      "The count of registrations of the agents, the reconnects are counted too.",
+	}, []string{"agent"})
+	protocolErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "protocol_errors_total",
+		Help:      "The count of protocol violations of the agents by reason, such as frame_too_large.",
+	}, []string{"agent", "reason"})
+)
+
+// Register the metrics of server into the default registry of prometheus
+func RegisterServerMetrics() {
+	prometheus.MustRegister(requestsTotal, requestDuration, inflightRequests, timeoutsTotal, connectionsTotal, protocolErrorsTotal, newConnCollector())
+	GetManager().Subscribe(func(e ConnEvent) {
+		if e.Type != DISCONNECTED {
+			connectionsTotal.WithLabelValues(e.Identifier).Inc()
+		}
+	})
+}
+
+// Track a request proxied to the middleware of agent, the returned function must be called with the result code
+// once the response arrives
+func TrackRequest(agent, middleware string) func(code string) {
+	start := time.Now()
+	inflight := inflightRequests.WithLabelValues(agent, middleware)
+	inflight.Inc()
+	var done int32
+	return func(code string) {
+		if !atomic.CompareAndSwapInt32(&done, 0, 1) {
+			return
+		}
+		inflight.Dec()
+		requestDuration.WithLabelValues(agent, middleware).Observe(time.Since(start).Seconds())
+		requestsTotal.WithLabelValues(agent, middleware, code).Inc()
+	}
+}
+
+func RecordTimeout(agent, middleware string) {
+	timeoutsTotal.WithLabelValues(agent, middleware).Inc()
+}
+
+func RecordProtocolError(agent, reason string) {
+	protocolErrorsTotal.WithLabelValues(agent, reason).Inc()
+}
+
+// The collector reads the statistics of connections when scraped, the counters start from zero for every connection
+type connCollector struct {
+	connected *prometheus.Desc
+	bytesIn   *prometheus.Desc
+	bytesOut  *prometheus.Desc
+	commands  *prometheus.Desc
+	rtt       *prometheus.Desc
+	ratio     *prometheus.Desc
+}
+
+func newConnCollector() *connCollector {
+	return &connCollector{
+		connected: prometheus.NewDesc(metricsNamespace+"_connected_agents", "The count of connected agents.", nil, nil),
+		bytesIn: prometheus.NewDesc(metricsNamespace+"_agent_received_bytes_total",
+			"The bytes received from the agent in current connection.", []string{"agent"}, nil),
+		bytesOut: prometheus.NewDesc(metricsNamespace+"_agent_sent_bytes_total",
+			"The bytes sent to the agent in current connection.", []string{"agent"}, nil),
+		commands: prometheus.NewDesc(metricsNamespace+"_agent_commands_total",
+			"The count of commands sent to the agent in current connection.", []string{"agent"}, nil),
+		rtt: prometheus.NewDesc(metricsNamespace+"_agent_rtt_seconds",
+			"The round trip time of the last heartbeat to the agent.", []string{"agent"}, nil),
+		ratio: prometheus.NewDesc(metricsNamespace+"_agent_compression_ratio",
+			"The ratio of payload bytes before and after compression of the agent in current connection.", []string{"agent"}, nil),
+	}
+}
+
+func (c *connCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connected
+	ch <- c.bytesIn
+	ch <- c.bytesOut
+	ch <- c.commands
+	ch <- c.rtt
+	ch <- c.ratio
+}
+
+func (c *connCollector) Collect(ch chan<- prometheus.Metric) {
+	conns := GetManager().List()
+	ch <- prometheus.MustNewConstMetric(c.connected, prometheus.GaugeValue, float64(len(conns)))
+	for _, qc := range conns {
+		ch <- prometheus.MustNewConstMetric(c.bytesIn, prometheus.CounterValue, float64(atomic.LoadInt64(&qc.stats.bytesIn)), qc.Identifier)
+		ch <- prometheus.MustNewConstMetric(c.bytesOut, prometheus.CounterValue, float64(atomic.LoadInt64(&qc.stats.bytesOut)), qc.Identifier)
+		ch <- prometheus.MustNewConstMetric(c.commands, prometheus.CounterValue, float64(atomic.LoadInt64(&qc.stats.requests)), qc.Identifier)
+		if atomic.LoadInt64(&qc.stats.lastHeartbeat) != 0 {
+			rtt := time.Duration(atomic.LoadInt64(&qc.stats.rtt))
+			ch <- prometheus.MustNewConstMetric(c.rtt, prometheus.GaugeValue, rtt.Seconds(), qc.Identifier)
+		}
+		if qc.compression != nil {
+			ch <- prometheus.MustNewConstMetric(c.ratio, prometheus.GaugeValue, qc.compression.Ratio(), qc.Identifier)
+		}
+	}
+}
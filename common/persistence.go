@@ -3,18 +3,103 @@ package common
 import (
 	"fmt"
 	"github.com/google/uuid"
+	"io"
+	"sync"
+	"time"
 )
 
 type Agent struct {
 	Name        string `json:"name" yaml:"name"`
 	Identifier  string `json:"identifier" yaml:"identifier" gorm:"primary_key"`
 	Description string `json:"description" yaml:"description"`
+	// The secret to authenticate the agent, it's only returned when the agent is created
+	Secret string `json:"secret,omitempty" yaml:"secret"`
+	// The seconds to wait for the response of the agent, the server default is used if it's 0
+	Timeout int `json:"timeout,omitempty" yaml:"timeout"`
+}
+
+const (
+	MiddlewareHTTP = "http"
+	MiddlewareTCP  = "tcp"
+
+	// The sources of middlewares, declared by operator through rest api or advertised by agent when registering
+	SourceOperator = "operator"
+	SourceAgent    = "agent"
+
+	// The verification modes of the certificate of https targets
+	TlsVerify   = "verify"
+	TlsVerifyCA = "verify-ca"
+	TlsInsecure = "insecure"
+)
+
+// The TLS settings to connect the https target of middleware, the files are read in the agent side
+type TargetTls struct {
+	// The verification mode, verify by default. verify-ca verifies the certificate chain but not the host name, which
+	// is useful for the devices addressed by IP, and insecure skips the verification.
+	Mode string `json:"mode,omitempty" yaml:"mode"`
+	// The CA bundle to verify the target, the system roots are used if it's empty
+	CaFile string `json:"caFile,omitempty" yaml:"caFile"`
+	// The client certificate and key presented to the target
+	CertFile string `json:"certFile,omitempty" yaml:"certFile"`
+	KeyFile  string `json:"keyFile,omitempty" yaml:"keyFile"`
+}
+
+func (t *TargetTls) validate() bool {
+	switch t.Mode {
+	case "", TlsVerify, TlsVerifyCA, TlsInsecure:
+	default:
+		return false
+	}
+	return (t.CertFile == "") == (t.KeyFile == "")
 }
 
 type Middleware struct {
 	Name string `json:"name" yaml:"name"`
+	// The type of middleware, http or tcp, default to http
+	Type string `json:"type,omitempty" yaml:"type"`
 	Path string `json:"path" yaml:"path"`
 	Port int    `json:"port" yaml:"port"`
+	// The target host in agent side, such as a device in the LAN of agent, default to 127.0.0.1
+	Host string `json:"host,omitempty" yaml:"host"`
+	// The scheme of http middleware, http or https, default to http
+	Scheme string `json:"scheme,omitempty" yaml:"scheme"`
+	// The TLS settings of https middleware
+	Tls *TargetTls `json:"tls,omitempty" yaml:"tls"`
+	// The port that server listens for tcp middleware, a free port is allocated if it's 0
+	ListenPort int `json:"listenPort,omitempty" yaml:"listenPort"`
+	// The seconds to wait for the response of the middleware, the timeout of agent is used if it's 0
+	Timeout int `json:"timeout,omitempty" yaml:"timeout"`
+	// The max bytes of request bodies to the middleware, the server default is used if it's 0
+	MaxBodySize int64 `json:"maxBodySize,omitempty" yaml:"maxBodySize"`
+	// The path to check the health of http middleware, such as /ping
+	HealthCheck string `json:"healthCheck,omitempty" yaml:"healthCheck"`
+	// Who declares the middleware, operator or agent, default to operator
+	Source string `json:"source,omitempty" yaml:"source"`
+}
+
+func (mc *Middleware) IsTCP() bool {
+	return mc.Type == MiddlewareTCP
+}
+
+// The timeout of the commands to the middleware, which is the first one configured in middleware, agent and server
+func CommandTimeout(agent *Agent, mw *Middleware) time.Duration {
+	if mw != nil && mw.Timeout > 0 {
+		return time.Duration(mw.Timeout) * time.Second
+	}
+	if agent != nil && agent.Timeout > 0 {
+		return time.Duration(agent.Timeout) * time.Second
+	}
+	return GetCommandTimeout()
+}
+
+// The max bytes of request bodies to the middleware, which is the first one configured in middleware and server.
+// There is no limit if it's 0.
+func MaxBodySize(mw *Middleware) int64 {
+	if mw != nil && mw.MaxBodySize > 0 {
+		return mw.MaxBodySize
+	}
+	conf, _ := GetSrvConf()
+	return conf.Rest.MaxBodySize
 }
 
 type AgentManager interface {
@@ -22,9 +107,13 @@ type AgentManager interface {
 	Add(node Agent) (*Agent, error)
 	Update(node Agent) (*Agent, error)
 	DeleteById(identifier string) error
+	GetById(identifier string) (*Agent, error)
 }
 
+// The agents are read by the registrations of agents while the rest handlers write them, so the cache is guarded by
+// the lock
 type AgentMemoryManager struct {
+	mu    sync.RWMutex
 	Cache map[string]*Agent
 }
 
@@ -46,6 +135,8 @@ func (n *Agent) validate() bool {
 }
 
 func (nc *AgentMemoryManager) List() ([]Agent, error) {
+	nc.mu.RLock()
+	defer nc.mu.RUnlock()
 	mwares := make([]Agent, 0)
 	for _, v := range nc.Cache {
 		mwares = append(mwares, *v)
@@ -54,24 +145,37 @@ func (nc *AgentMemoryManager) List() ([]Agent, error) {
 }
 
 func (nc *AgentMemoryManager) Add(n Agent) (*Agent, error) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
 	uuid, _ := uuid.NewUUID()
 	n.Identifier = uuid.String()
+	n.Secret = GenerateSecret()
 	nc.Cache[n.Identifier] = &n
 	return &n, nil
 }
 
 func (nc *AgentMemoryManager) Update(n Agent) (*Agent, error) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
 	if !n.validate() {
 		return nil, fmt.Errorf("Not valid node settings %v", n)
 	}
 	if n.Identifier == "" {
 		return nil, fmt.Errorf("Identifier is expected %v", n)
 	}
+	// The secret is always generated by server, it cannot be changed by the caller
+	if old := nc.Cache[n.Identifier]; old != nil {
+		n.Secret = old.Secret
+	} else {
+		n.Secret = GenerateSecret()
+	}
 	nc.Cache[n.Identifier] = &n
 	return &n, nil
 }
 
 func (nc *AgentMemoryManager) DeleteById(id string) error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
 	if id == "" {
 		return fmt.Errorf("id %s cannot be empty", id)
 	}
@@ -79,6 +183,16 @@ func (nc *AgentMemoryManager) DeleteById(id string) error {
 	return nil
 }
 
+func (nc *AgentMemoryManager) GetById(id string) (*Agent, error) {
+	nc.mu.RLock()
+	defer nc.mu.RUnlock()
+	if n := nc.Cache[id]; n != nil {
+		a := *n
+		return &a, nil
+	}
+	return nil, fmt.Errorf("Cannot find the node with id %s", id)
+}
+
 type Middlewares []Middleware
 
 type MiddlewareManager interface {
@@ -86,7 +200,7 @@ type MiddlewareManager interface {
 	Add(nodeid string, middleware Middleware) (*Middleware, error)
 	Update(nodeid string, middleware Middleware) (*Middleware, error)
 	DeleteByName(nodeid string, name string) error
-	GetByName(nodeid string, name string) error
+	GetByName(nodeid string, name string) (*Middleware, error)
 }
 
 func (mws *Middlewares) GetMiddlewareByName(name string) *Middleware {
@@ -98,11 +212,16 @@ func (mws *Middlewares) GetMiddlewareByName(name string) *Middleware {
 	return nil
 }
 
+// The middlewares are read and written by both the rest handlers and the registrations of agents, so the cache is
+// guarded by the lock
 type MWMemoryCache struct {
+	mu    sync.RWMutex
 	Cache map[string]Middlewares
 }
 
-func (mc *MWMemoryCache) List(nodeid string) ([]Middleware, error) {
+func (mc *MWMemoryCache) List(nodeid string) (Middlewares, error) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
 	mws := mc.Cache[nodeid]
 	if mws == nil {
 		return nil, fmt.Errorf("Cannot find middlewares for id %s", nodeid)
@@ -115,6 +234,8 @@ func (mc *MWMemoryCache) List(nodeid string) ([]Middleware, error) {
 }
 
 func (mc *MWMemoryCache) Add(nodeid string, m Middleware) (*Middleware, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
 	if !m.validateMiddleware() {
 		return nil, fmt.Errorf("Not valid middleware settings %v", m)
 	}
@@ -129,13 +250,31 @@ func (mc *MWMemoryCache) Add(nodeid string, m Middleware) (*Middleware, error) {
 }
 
 func (mc *Middleware) validateMiddleware() bool {
-	if mc.Name == "" || mc.Path == "" || mc.Port == 0 {
+	switch mc.Type {
+	case "", MiddlewareHTTP:
+		switch mc.Scheme {
+		case "", "http":
+			if mc.Tls != nil {
+				return false
+			}
+		case "https":
+			if mc.Tls != nil && !mc.Tls.validate() {
+				return false
+			}
+		default:
+			return false
+		}
+		return mc.Name != "" && mc.Path != "" && mc.Port != 0
+	case MiddlewareTCP:
+		return mc.Name != "" && mc.Port != 0
+	default:
 		return false
 	}
-	return true
 }
 
 func (mc *MWMemoryCache) Update(nodeid string, m Middleware) (*Middleware, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
 	if !m.validateMiddleware() {
 		return nil, fmt.Errorf("Not valid middleware settings %v", m)
 	}
@@ -164,6 +303,8 @@ func removeMware(middlewares Middlewares, s int) Middlewares {
 }
 
 func (mc *MWMemoryCache) DeleteByName(nodeid string, name string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
 	if nodeid == "" || name == "" {
 		return fmt.Errorf("nodeid or name cannot be empty ")
 	}
@@ -187,6 +328,8 @@ func (mc *MWMemoryCache) DeleteByName(nodeid string, name string) error {
 }
 
 func (mc *MWMemoryCache) GetByName(nodeid string, name string) (*Middleware, error) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
 	if nodeid == "" || name == "" {
 		return nil, fmt.Errorf("nodeid or name cannot be empty ")
 	}
@@ -212,3 +355,70 @@ func NewMWMemoryCache() *MWMemoryCache {
 	}
 	return memCache
 }
+
+const (
+	StoreMemory = "memory"
+	StoreBolt   = "bolt"
+)
+
+var (
+	agentManager      AgentManager
+	middlewareManager MiddlewareManager
+)
+
+// Init the agent and middleware managers with the store settings, the memory store is used by default
+func InitManagers(conf StoreConfig) error {
+	switch conf.Type {
+	case "", StoreMemory:
+		agentManager = NewNodeMemCache()
+		middlewareManager = NewMWMemoryCache()
+	case StoreBolt:
+		store, err := NewBoltStore(conf.Path)
+		if err != nil {
+			return err
+		}
+		agentManager = &BoltAgentManager{store}
+		middlewareManager = &BoltMWManager{store}
+	default:
+		return fmt.Errorf("Not supported store type %s", conf.Type)
+	}
+	return nil
+}
+
+// Close the store of managers, the pending writes are flushed and the file lock of bolt store is released
+func CloseManagers() {
+	if c, ok := agentManager.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			Log.Errorf("Failed to close the store: %v", err)
+		}
+	}
+}
+
+func GetAgentManager() AgentManager {
+	if agentManager == nil {
+		agentManager = NewNodeMemCache()
+	}
+	return agentManager
+}
+
+func GetMiddlewareManager() MiddlewareManager {
+	if middlewareManager == nil {
+		middlewareManager = NewMWMemoryCache()
+	}
+	return middlewareManager
+}
+
+// Release the resources of the deleted agent, including the forwards and the middlewares, and its live connection
+func PurgeAgent(nodeid string) {
+	if mws, err := GetMiddlewareManager().List(nodeid); err == nil {
+		for _, mw := range mws {
+			StopForward(nodeid, mw.Name)
+			if err := GetMiddlewareManager().DeleteByName(nodeid, mw.Name); err != nil {
+				Log.Errorf("Failed to delete middleware %s of deleted node %s: %v", mw.Name, nodeid, err)
+			}
+		}
+	}
+	if qc := GetManager().GetConn(nodeid); qc != nil {
+		qc.Close("the agent is deleted")
+	}
+}
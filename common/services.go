@@ -0,0 +1,116 @@
+package common
+
+import "fmt"
+
+// Service is a local service advertised by the agent when registering, so that it's reachable without declaring the
+// middleware through rest api
+type Service struct {
+	Name string `json:"name" yaml:"name"`
+	// The type of service, http or tcp, default to http
+	Type string `json:"type,omitempty" yaml:"type"`
+	// The host of service, default to 127.0.0.1
+	Host string `json:"host,omitempty" yaml:"host"`
+	Port int    `json:"port" yaml:"port"`
+	// The base path of http service, default to /
+	Path string `json:"path,omitempty" yaml:"path"`
+	// The path to check the health of http service
+	HealthCheck string `json:"healthCheck,omitempty" yaml:"healthCheck"`
+}
+
+func (s Service) toMiddleware() Middleware {
+	mw := Middleware{
+		Name:        s.Name,
+		Type:        s.Type,
+		Host:        s.Host,
+		Port:        s.Port,
+		Path:        s.Path,
+		HealthCheck: s.HealthCheck,
+		Source:      SourceAgent,
+	}
+	if !mw.IsTCP() && mw.Path == "" {
+		mw.Path = "/"
+	}
+	return mw
+}
+
+// Whether the middleware declared by agent is changed by the advertised one, the settings of server side are ignored
+func (mw *Middleware) serviceChanged(n Middleware) bool {
+	return mw.Type != n.Type || mw.Host != n.Host || mw.Port != n.Port || mw.Path != n.Path || mw.HealthCheck != n.HealthCheck
+}
+
+// Merge the services advertised by the agent into its middlewares. The middlewares declared by operator take
+// precedence over the services of the same name, and the middlewares declared by agent but not advertised anymore
+// are removed. The tcp services are ignored unless they are allowed by server, since they open ports in server.
+func mergeServices(nodeid string, services []Service) {
+	conf, _ := GetSrvConf()
+	existing, _ := GetMiddlewareManager().List(nodeid)
+	advertised := make(map[string]bool)
+	for _, s := range services {
+		mw := s.toMiddleware()
+		if mw.IsTCP() && !conf.Basic.AllowAgentTcpServices {
+			Log.Warnf("The tcp service %s advertised by agent %s is ignored, since allowAgentTcpServices is disabled.", s.Name, nodeid)
+			continue
+		}
+		advertised[s.Name] = true
+		old := existing.GetMiddlewareByName(s.Name)
+		if old != nil && old.Source != SourceAgent {
+			Log.Warnf("The service %s advertised by agent %s is ignored, since it's declared by operator.", s.Name, nodeid)
+			continue
+		}
+		if old != nil && !old.serviceChanged(mw) {
+			continue
+		}
+		if err := saveService(nodeid, old, mw); err != nil {
+			Log.Errorf("Failed to merge the service %s advertised by agent %s: %v", s.Name, nodeid, err)
+		} else {
+			Log.Infof("The service %s advertised by agent %s is merged.", s.Name, nodeid)
+		}
+	}
+	for _, mw := range existing {
+		if mw.Source == SourceAgent && !advertised[mw.Name] {
+			if mw.IsTCP() {
+				StopForward(nodeid, mw.Name)
+			}
+			if err := GetMiddlewareManager().DeleteByName(nodeid, mw.Name); err != nil {
+				Log.Errorf("Failed to remove the service %s of agent %s: %v", mw.Name, nodeid, err)
+			} else {
+				Log.Infof("The service %s is removed since agent %s doesn't advertise it anymore.", mw.Name, nodeid)
+			}
+		}
+	}
+}
+
+// Add or update the middleware of the service, the forward of tcp service keeps listening at the same port
+func saveService(nodeid string, old *Middleware, mw Middleware) error {
+	if old != nil {
+		mw.ListenPort = old.ListenPort
+		mw.Timeout = old.Timeout
+		mw.MaxBodySize = old.MaxBodySize
+		if old.IsTCP() {
+			StopForward(nodeid, old.Name)
+		}
+	}
+	if mw.IsTCP() {
+		if err := StartForward(nodeid, &mw); err != nil {
+			return err
+		}
+	}
+	var err error
+	if old == nil {
+		_, err = GetMiddlewareManager().Add(nodeid, mw)
+	} else {
+		_, err = GetMiddlewareManager().Update(nodeid, mw)
+	}
+	if err != nil {
+		if mw.IsTCP() {
+			StopForward(nodeid, mw.Name)
+		}
+		if old != nil && old.IsTCP() {
+			if e := StartForward(nodeid, old); e != nil {
+				Log.Errorf("Failed to restore forward for middleware %s of node %s: %v", old.Name, nodeid, e)
+			}
+		}
+		return fmt.Errorf("invalid service %v: %v", mw, err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package common
+
+import (
+	"github.com/lucas-clemente/quic-go"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The statistics of a connection, the counters are updated atomically
+type connStats struct {
+	connectedSince time.Time
+	// Unix nano of the last time receiving data from client
+	lastSeen int64
+	version  uint32
+	bytesIn  int64
+	bytesOut int64
+	requests int64
+	// Unix nano of the last pong, and the round trip time in nano of it
+	lastHeartbeat int64
+	rtt           int64
+	// The count of pings without pong in a row
+	misses int32
+}
+
+func (cs *connStats) seen() {
+	atomic.StoreInt64(&cs.lastSeen, time.Now().UnixNano())
+}
+
+// The stream counts the bytes read and written in the statistics of connection
+type countingStream struct {
+	quic.Stream
+	stats *connStats
+}
+
+func (s *countingStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&s.stats.bytesIn, int64(n))
+		s.stats.seen()
+	}
+	return n, err
+}
+
+func (s *countingStream) Write(p []byte) (int, error) {
+	n, err := s.Stream.Write(p)
+	atomic.AddInt64(&s.stats.bytesOut, int64(n))
+	return n, err
+}
+
+// The status of an agent connection
+type ConnStatus struct {
+	Online         bool       `json:"online"`
+	RemoteAddr     string     `json:"remoteAddr,omitempty"`
+	ConnectedSince *time.Time `json:"connectedSince,omitempty"`
+	LastSeen       *time.Time `json:"lastSeen,omitempty"`
+	LastHeartbeat  *time.Time `json:"lastHeartbeat,omitempty"`
+	// The round trip time of the last heartbeat
+	Rtt string `json:"rtt,omitempty"`
+	// The version in package header of the client
+	Version string `json:"version,omitempty"`
+	// The bytes received from and sent to the client
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+	// The count of requests proxied to the client
+	Requests int64 `json:"requests"`
+	// The capabilities enabled for the agent
+	Capabilities []string `json:"capabilities,omitempty"`
+	// The negotiated compression algorithm, and the ratio of payload bytes before and after compression
+	Compression      string  `json:"compression,omitempty"`
+	CompressionRatio float64 `json:"compressionRatio,omitempty"`
+}
+
+// Return the status of the connection
+func (qc *QuicConnection) Status() ConnStatus {
+	since := qc.stats.connectedSince
+	status := ConnStatus{
+		Online:         true,
+		RemoteAddr:     qc.Session.RemoteAddr().String(),
+		ConnectedSince: &since,
+		BytesIn:        atomic.LoadInt64(&qc.stats.bytesIn),
+		BytesOut:       atomic.LoadInt64(&qc.stats.bytesOut),
+		Requests:       atomic.LoadInt64(&qc.stats.requests),
+	}
+	status.Capabilities = qc.capabilities
+	if qc.compression != nil {
+		status.Compression = qc.compression.Algorithm()
+		status.CompressionRatio = qc.compression.Ratio()
+	}
+	if v := atomic.LoadUint32(&qc.stats.version); v != 0 {
+		status.Version = VersionString(v)
+	}
+	if ls := atomic.LoadInt64(&qc.stats.lastSeen); ls != 0 {
+		t := time.Unix(0, ls)
+		status.LastSeen = &t
+	}
+	if lh := atomic.LoadInt64(&qc.stats.lastHeartbeat); lh != 0 {
+		t := time.Unix(0, lh)
+		status.LastHeartbeat = &t
+		status.Rtt = time.Duration(atomic.LoadInt64(&qc.stats.rtt)).String()
+	}
+	return status
+}
+
+// The last status of the disconnected agents, which is kept in memory until the agent connects again
+var offlineStatus = struct {
+	items map[string]ConnStatus
+	mu    sync.RWMutex
+}{items: make(map[string]ConnStatus)}
+
+func init() {
+	GetManager().Subscribe(func(e ConnEvent) {
+		offlineStatus.mu.Lock()
+		defer offlineStatus.mu.Unlock()
+		if e.Type == DISCONNECTED {
+			status := e.Conn.Status()
+			status.Online = false
+			offlineStatus.items[e.Identifier] = status
+		} else {
+			delete(offlineStatus.items, e.Identifier)
+		}
+	})
+}
+
+// Return the status of the agent, the last status is returned if it's disconnected
+func GetConnStatus(id string) ConnStatus {
+	if qc := GetManager().GetConn(id); qc != nil {
+		return qc.Status()
+	}
+	offlineStatus.mu.RLock()
+	defer offlineStatus.mu.RUnlock()
+	return offlineStatus.items[id]
+}
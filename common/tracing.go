@@ -0,0 +1,68 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// The attributes of the spans of wormhole
+const (
+	AttrAgent        = label.Key("wormhole.agent")
+	AttrMiddleware   = label.Key("wormhole.middleware")
+	AttrSequence     = label.Key("wormhole.sequence")
+	AttrTunnelTime   = label.Key("wormhole.tunnel_time_ms")
+	AttrUpstreamTime = label.Key("wormhole.upstream_time_ms")
+)
+
+// Init the W3C trace context propagation, and export the spans to the OTLP collector if tracing is enabled.
+// The returned function flushes the pending spans and stops the exporter.
+func InitTracing(conf TracingConfig, service string, attrs ...label.KeyValue) (func(), error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if !conf.Enable {
+		return func() {}, nil
+	}
+	opts := []otlp.ExporterOption{otlp.WithInsecure()}
+	if conf.Endpoint != "" {
+		opts = append(opts, otlp.WithAddress(conf.Endpoint))
+	}
+	exporter, err := otlp.NewExporter(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create OTLP exporter: %v", err)
+	}
+	ratio := conf.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))}),
+		sdktrace.WithResource(resource.NewWithAttributes(append(attrs, semconv.ServiceNameKey.String(service))...)),
+		sdktrace.WithBatcher(exporter),
+	)
+	otel.SetTracerProvider(tp)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			Log.Errorf("Failed to flush spans: %v", err)
+		}
+		exporter.Shutdown(ctx)
+	}, nil
+}
+
+func Tracer() trace.Tracer {
+	return otel.Tracer("github.com/emqx/wormhole")
+}
+
+// Milliseconds of the duration as a float attribute value
+func DurationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -1,3 +1,3 @@
 #!/bin/bash
 
-nohup fvt/wormhole_agent client $1 > agent_client.out 2>&1 &
+WORMHOLE_CONF_DIR=fvt/etc WORMHOLE_AGENT_SECRET=$2 nohup fvt/wormhole_agent client $1 > agent_client.out 2>&1 &
@@ -0,0 +1,37 @@
+#!/bin/bash
+#
+# Verify that the requests and responses are proxied losslessly through the echo endpoint of fvt/mserver.
+#
+# Example:
+#
+# ./fvt/check_fidelity.sh 04d63e52-4f58-11eb-accc-f45c89b00d3d
+#
+
+set -e
+
+node=$1
+server=${2:-http://127.0.0.1:9999}
+
+curl -s -X POST "$server/nodes/$node/mware" -d '{"name": "echo", "port": 9081, "path": "/echo"}' > /dev/null
+
+out=`curl -s -i --raw -X PATCH "$server/wh/$node/echo/a%2Fb/c%23d?x=1&x=2&y=%20" -H "X-Multi: 1" -H "X-Multi: 2" -d "hello"`
+echo "$out"
+
+function expect
+{
+  if ! echo "$out" | grep -q -- "$1"; then
+    echo "Missing $1"
+    exit 1
+  fi
+}
+
+expect "HTTP/1.1 202"
+expect "Set-Cookie: a=1"
+expect "Set-Cookie: b=2"
+expect '"method":"PATCH"'
+expect '"path":"/echo/a%2Fb/c%23d"'
+expect '"query":"x=1\&x=2\&y=%20"'
+expect '"X-Multi":\["1","2"\]'
+expect '"body":"hello"'
+expect "X-Echo-Length: 5"
+echo "Passed"
@@ -6,9 +6,11 @@ import (
 	"github.com/emqx/wormhole/rest"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 )
@@ -67,6 +69,28 @@ func deletestream(w http.ResponseWriter, req *http.Request) {
 	jsonResponse(result, w)
 }
 
+// Echo the request as is, so that the fidelity of proxying can be verified. The response has multi-value headers and
+// a trailer.
+func echo(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	body, _ := ioutil.ReadAll(req.Body)
+	w.Header().Add("Set-Cookie", "a=1")
+	w.Header().Add("Set-Cookie", "b=2")
+	w.Header().Set("Trailer", "X-Echo-Length")
+	w.Header().Set(rest.ContentType, rest.ContentTypeJSON)
+	w.WriteHeader(http.StatusAccepted)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(map[string]interface{}{
+		"method":  req.Method,
+		"path":    req.URL.EscapedPath(),
+		"query":   req.URL.RawQuery,
+		"headers": req.Header,
+		"body":    string(body),
+	})
+	w.Header().Set("X-Echo-Length", strconv.Itoa(len(body)))
+}
+
 func createRestServer(port int) *http.Server {
 	r := mux.NewRouter()
 
@@ -74,6 +98,7 @@ func createRestServer(port int) *http.Server {
 	r.HandleFunc("/streams", poststream).Methods(http.MethodPost)
 	r.HandleFunc("/streams", updatestream).Methods(http.MethodPut)
 	r.HandleFunc("/streams", deletestream).Methods(http.MethodDelete)
+	r.PathPrefix("/echo").HandlerFunc(echo)
 
 	server := &http.Server{
 		Addr: fmt.Sprintf("0.0.0.0:%d", port),
@@ -4,11 +4,18 @@ go 1.15
 
 require (
 	github.com/go-yaml/yaml v2.1.0+incompatible
+	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/google/uuid v1.1.2
 	github.com/gorilla/handlers v1.4.2
 	github.com/gorilla/mux v1.7.3
 	github.com/keepeye/logrus-filename v0.0.0-20190711075016-ce01a4391dd1
 	github.com/lucas-clemente/quic-go v0.7.1-0.20201124020523-a76879c30599
 	github.com/mitchellh/mapstructure v1.4.0 // indirect
+	github.com/prometheus/client_golang v1.7.0
 	github.com/sirupsen/logrus v1.4.2
+	github.com/vmihailenco/msgpack/v4 v4.3.12
+	go.etcd.io/bbolt v1.3.5
+	go.opentelemetry.io/otel v0.15.0
+	go.opentelemetry.io/otel/exporters/otlp v0.15.0
+	go.opentelemetry.io/otel/sdk v0.15.0
 )
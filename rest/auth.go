@@ -0,0 +1,176 @@
+package rest
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"github.com/emqx/wormhole/common"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+)
+
+const (
+	HeaderApiKey        = "X-API-Key"
+	HeaderAuthorization = "Authorization"
+)
+
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleReadOnly = "readonly"
+)
+
+type permission int
+
+const (
+	// Read nodes and middlewares
+	permRead permission = iota
+	// Call the services of agents through /wh/ routes
+	permProxy
+	// Register, update and delete middlewares
+	permMiddleware
+	// Register, update and delete nodes
+	permNode
+)
+
+var rolePermissions = map[string][]permission{
+	RoleAdmin:    {permRead, permProxy, permMiddleware, permNode},
+	RoleOperator: {permRead, permProxy, permMiddleware},
+	RoleReadOnly: {permRead},
+}
+
+// The authenticated caller of rest api
+type principal struct {
+	Name string
+	Role string
+	// The agents that the principal can access, all agents can be accessed if it's empty
+	Agents []string
+}
+
+func (p *principal) can(perm permission) bool {
+	for _, pm := range rolePermissions[p.Role] {
+		if pm == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *principal) canAccess(id string) bool {
+	if len(p.Agents) == 0 {
+		return true
+	}
+	for _, a := range p.Agents {
+		if a == id {
+			return true
+		}
+	}
+	return false
+}
+
+// The claims of JWT bearer token
+type claims struct {
+	Role   string   `json:"role"`
+	Agents []string `json:"agents"`
+	jwt.StandardClaims
+}
+
+type authenticator struct {
+	conf common.AuthConfig
+}
+
+type principalKey struct{}
+
+func principalFrom(ctx context.Context) *principal {
+	p, _ := ctx.Value(principalKey{}).(*principal)
+	return p
+}
+
+// Authenticate the request with either the api key or the JWT bearer token
+func (a *authenticator) authenticate(req *http.Request) (*principal, error) {
+	if key := req.Header.Get(HeaderApiKey); key != "" {
+		for _, k := range a.conf.ApiKeys {
+			if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+				req.Header.Del(HeaderApiKey)
+				return &principal{Name: "apikey", Role: k.Role, Agents: k.Agents}, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid api key")
+	}
+	if auth := req.Header.Get(HeaderAuthorization); strings.HasPrefix(auth, "Bearer ") && a.conf.JwtSecret != "" {
+		c := &claims{}
+		_, err := jwt.ParseWithClaims(strings.TrimPrefix(auth, "Bearer "), c, func(t *jwt.Token) (interface{}, error) {
+			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+			}
+			return []byte(a.conf.JwtSecret), nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid bearer token: %v", err)
+		}
+		req.Header.Del(HeaderAuthorization)
+		return &principal{Name: c.Subject, Role: c.Role, Agents: c.Agents}, nil
+	}
+	return nil, fmt.Errorf("api key or bearer token is required")
+}
+
+// Wrap the handler to check the permission of caller. If the route has an agent id, the caller must be able to
+// access the agent; otherwise a mutation is only allowed for the caller which can access all agents.
+func (a *authenticator) authorize(perm permission, h http.HandlerFunc) http.HandlerFunc {
+	if !a.conf.Enable {
+		return h
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		p, err := a.authenticate(req)
+		if err != nil {
+			common.Log.Errorf("Unauthorized request %s %s from %s: %v", req.Method, req.URL.Path, req.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		allowed := p.can(perm)
+		if id, ok := mux.Vars(req)["id"]; ok {
+			allowed = allowed && p.canAccess(id)
+		} else if perm != permRead {
+			allowed = allowed && len(p.Agents) == 0
+		}
+		if !allowed {
+			common.Log.Errorf("Forbidden request %s %s from %s with role %s", req.Method, req.URL.Path, p.Name, p.Role)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, req.WithContext(context.WithValue(req.Context(), principalKey{}, p)))
+	}
+}
+
+// Wrap the handler which exposes the data of all agents, it's forbidden for the caller limited to some agents
+func unscoped(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if p := principalFrom(req.Context()); p != nil && len(p.Agents) > 0 {
+			common.Log.Errorf("Forbidden request %s %s from %s limited to agents %v", req.Method, req.URL.Path, p.Name, p.Agents)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// Validate the auth settings
+func validateAuthConfig(conf common.AuthConfig) error {
+	if !conf.Enable {
+		return nil
+	}
+	if len(conf.ApiKeys) == 0 && conf.JwtSecret == "" {
+		return fmt.Errorf("either apiKeys or jwtSecret is required when auth is enabled")
+	}
+	for _, k := range conf.ApiKeys {
+		if k.Key == "" {
+			return fmt.Errorf("api key cannot be empty")
+		}
+		if _, ok := rolePermissions[k.Role]; !ok {
+			return fmt.Errorf("unknown role %s of api key", k.Role)
+		}
+	}
+	return nil
+}
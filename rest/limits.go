@@ -0,0 +1,49 @@
+package rest
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+var errBodyTooLarge = errors.New("the request body is too large")
+
+// limitedBody fails the reading once the body exceeds the limit, so that the stream to agent is aborted and the
+// request is rejected with 413. It's read by the goroutine streaming the body to agent.
+type limitedBody struct {
+	body      io.Reader
+	remaining int64
+	max       int64
+	exceeded  int32
+}
+
+func newLimitedBody(body io.Reader, limit int64) *limitedBody {
+	return &limitedBody{body: body, remaining: limit, max: limit}
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&lb.exceeded) == 1 {
+		return 0, errBodyTooLarge
+	}
+	// Read one more byte than the remaining to find out whether the body exceeds the limit
+	if int64(len(p)) > lb.remaining+1 {
+		p = p[:lb.remaining+1]
+	}
+	n, err := lb.body.Read(p)
+	if int64(n) > lb.remaining {
+		n = int(lb.remaining)
+		lb.remaining = 0
+		atomic.StoreInt32(&lb.exceeded, 1)
+		return n, errBodyTooLarge
+	}
+	lb.remaining -= int64(n)
+	return n, err
+}
+
+func (lb *limitedBody) isExceeded() bool {
+	return lb != nil && atomic.LoadInt32(&lb.exceeded) == 1
+}
+
+func (lb *limitedBody) limit() int64 {
+	return lb.max
+}
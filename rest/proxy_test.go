@@ -0,0 +1,28 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyPath(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/wh/node/kuiper/rules", "rules"},
+		{"/wh/node/kuiper/rules/demo/status", "rules/demo/status"},
+		{"/wh/node/kuiper/a%2Fb", "a%2Fb"},
+		{"/wh/node/kuiper/a%23b/c", "a%23b/c"},
+		{"/wh/node/kuiper/a%20b?x=1", "a%20b"},
+		{"/wh/node/kuiper/", ""},
+		{"/wh/node/kuiper", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if got := proxyPath(req); got != tt.want {
+			t.Errorf("proxyPath(%s) = %s, want %s", tt.target, got, tt.want)
+		}
+	}
+}
@@ -1,19 +1,25 @@
 package rest
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/emqx/wormhole/common"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"io/ioutil"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
 	ContentType     = "Content-Type"
 	ContentTypeJSON = "application/json"
+	// The header to override the timeout of proxied request, in seconds or duration such as 1m30s
+	HeaderTimeout = "X-Wormhole-Timeout"
 )
 
 func jsonResponse(i interface{}, w http.ResponseWriter) {
@@ -39,6 +45,33 @@ func handleError(w http.ResponseWriter, err error, prefix string) {
 	http.Error(w, message, ec)
 }
 
+func handleErrorCode(w http.ResponseWriter, err error, code int) {
+	common.Log.Error(err.Error())
+	http.Error(w, err.Error(), code)
+}
+
+// The timeout of proxied request, the header of request takes precedence over the settings of middleware and agent,
+// but it cannot exceed the max timeout, so that a caller cannot hold the stream and the agent for long
+func requestTimeout(req *http.Request, agent *common.Agent, ware *common.Middleware) (time.Duration, error) {
+	v := req.Header.Get(HeaderTimeout)
+	if v == "" {
+		return common.CommandTimeout(agent, ware), nil
+	}
+	req.Header.Del(HeaderTimeout)
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		d = time.Duration(secs) * time.Second
+	} else if pd, err := time.ParseDuration(v); err == nil && pd > 0 {
+		d = pd
+	} else {
+		return 0, fmt.Errorf("Invalid %s header %s.", HeaderTimeout, v)
+	}
+	if max := common.GetMaxCommandTimeout(); d > max {
+		return 0, fmt.Errorf("The %s header %s exceeds the max timeout %s.", HeaderTimeout, v, max)
+	}
+	return d, nil
+}
+
 func register(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	node := common.Agent{}
@@ -46,7 +79,7 @@ func register(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		handleError(w, err, "")
 	}
-	if n, err := common.NewNodeMemCache().Add(node); err != nil {
+	if n, err := common.GetAgentManager().Add(node); err != nil {
 		handleError(w, err, "")
 	} else {
 		jsonResponse(n, w)
@@ -61,9 +94,10 @@ func delete(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	vars := mux.Vars(req)
 	id := vars["id"]
-	if err := common.NewNodeMemCache().DeleteById(id); err != nil {
+	if err := common.GetAgentManager().DeleteById(id); err != nil {
 		handleError(w, err, "")
 	} else {
+		common.PurgeAgent(id)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(fmt.Sprintf("%s is deleted.", id)))
 	}
@@ -76,19 +110,56 @@ func update(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		handleError(w, err, "")
 	}
-	if n, err := common.NewNodeMemCache().Update(node); err != nil {
+	// The secret is only returned when the agent is created
+	_, err = common.GetAgentManager().GetById(node.Identifier)
+	created := err != nil
+	if n, err := common.GetAgentManager().Update(node); err != nil {
 		handleError(w, err, "")
 	} else {
+		if !created {
+			n.Secret = ""
+		}
 		jsonResponse(n, w)
 	}
 }
 
+// The agent with the status of its connection
+type agentView struct {
+	common.Agent
+	Status common.ConnStatus `json:"status"`
+}
+
+type middlewareView struct {
+	common.Middleware
+	Health common.MiddlewareHealth `json:"health"`
+}
+
 func list(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
-	if nodes, err := common.NewNodeMemCache().List(); err != nil {
+	if nodes, err := common.GetAgentManager().List(); err != nil {
 		handleError(w, err, "")
 	} else {
-		jsonResponse(nodes, w)
+		visible := make([]agentView, 0, len(nodes))
+		p := principalFrom(req.Context())
+		for _, n := range nodes {
+			if p == nil || p.canAccess(n.Identifier) {
+				n.Secret = ""
+				visible = append(visible, agentView{Agent: n, Status: common.GetConnStatus(n.Identifier)})
+			}
+		}
+		jsonResponse(visible, w)
+	}
+}
+
+func status(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	id := mux.Vars(req)["id"]
+	if node, err := common.GetAgentManager().GetById(id); err != nil {
+		handleError(w, fmt.Errorf("The specified node %s cannot be found.", id), "")
+	} else {
+		view := agentView{Agent: *node, Status: common.GetConnStatus(id)}
+		view.Secret = ""
+		jsonResponse(view, w)
 	}
 }
 
@@ -98,26 +169,71 @@ func processRequest(w http.ResponseWriter, req *http.Request) {
 
 	id := vars["id"]
 	mware := vars["mware"]
-	rest := vars["rest"]
+	rest := proxyPath(req)
 
-	node := common.NewNodeMemCache().Cache[id]
-	if node == nil {
+	node, err := common.GetAgentManager().GetById(id)
+	if err != nil {
 		handleError(w, fmt.Errorf("The specified node %s cannot be found.", id), "")
 		return
 	}
 
-	ware, err := common.NewMWMemoryCache().GetByName(id, mware)
+	ware, err := common.GetMiddlewareManager().GetByName(id, mware)
 	if err != nil {
 		handleError(w, fmt.Errorf("The specified middleware %s in node %s cannot be found.", mware, id), "")
+		return
 	}
+	if ware.IsTCP() {
+		handleError(w, fmt.Errorf("The middleware %s in node %s is a tcp middleware.", mware, id), "")
+		return
+	}
+
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	done := common.TrackRequest(id, mware)
+	defer func() { done(strconv.Itoa(rec.status())) }()
+	ctx, span := startProxySpan(req, id, mware)
+	defer func() { endProxySpan(span, rec.status()) }()
+	start := time.Now()
 
 	conn := common.GetManager().GetConn(id)
 	if conn == nil {
 		handleError(w, fmt.Errorf("The connection to node %s is not existed.", id), "")
 		return
 	}
+	if h := common.GetMiddlewareHealth(id, mware); h.Status == common.HealthDown {
+		handleErrorCode(w, fmt.Errorf("The middleware %s in node %s is down: %s", mware, id, h.Detail), http.StatusServiceUnavailable)
+		return
+	}
+
+	timeout, err := requestTimeout(req, node, ware)
+	if err != nil {
+		handleError(w, err, "")
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	body, err := ioutil.ReadAll(req.Body)
+	// The request body of an upgrade request is the data sent by caller after switching protocols
+	var reqBody io.Reader = req.Body
+	var upstream *io.PipeWriter
+	upgrade := common.IsUpgradeRequest(req.Header)
+	if upgrade && !conn.HasCapability(common.CapUpgrade) {
+		handleErrorCode(w, fmt.Errorf("The node %s doesn't support upgrade requests.", id), http.StatusNotImplemented)
+		return
+	}
+	if upgrade {
+		reqBody, upstream = io.Pipe()
+		defer upstream.Close()
+	}
+	var limited *limitedBody
+	if limit := common.MaxBodySize(ware); !upgrade && limit > 0 {
+		if req.ContentLength > limit {
+			handleErrorCode(w, fmt.Errorf("The request body exceeds the limit %d bytes of middleware %s.", limit, mware), http.StatusRequestEntityTooLarge)
+			return
+		}
+		limited = newLimitedBody(req.Body, limit)
+		reqBody = limited
+	}
 
 	cmd := common.HttpCommand{
 		BasicCommand: common.BasicCommand{
@@ -126,34 +242,72 @@ func processRequest(w http.ResponseWriter, req *http.Request) {
 			CType:      common.HTTP,
 		},
 		HttpRequest: common.HttpRequest{
-			Method:   req.Method,
-			Host:     "",
-			Port:     ware.Port,
-			BasePath: ware.Path,
-			Path:     rest,
-			Headers:  req.Header,
-			Body:     body,
+			Schema:        ware.Scheme,
+			Method:        req.Method,
+			Host:          ware.Host,
+			Port:          ware.Port,
+			BasePath:      ware.Path,
+			Path:          rest,
+			RawQuery:      req.URL.RawQuery,
+			Headers:       req.Header,
+			Tls:           ware.Tls,
+			ContentLength: req.ContentLength,
 		},
 	}
-	if resp, err := conn.SendCommand(&cmd); err != nil {
+	span.SetAttributes(common.AttrSequence.Int(cmd.Sequence))
+	if resp, body, err := conn.SendCommand(ctx, &cmd, reqBody); err == common.ErrCommandTimeout {
+		common.RecordTimeout(id, mware)
+		handleErrorCode(w, fmt.Errorf("No response from node %s in %s.", id, timeout), http.StatusGatewayTimeout)
+	} else if err == common.ErrConnectionClosed {
+		handleErrorCode(w, fmt.Errorf("The connection to node %s is closed.", id), http.StatusBadGateway)
+	} else if err != nil {
 		handleError(w, fmt.Errorf("Found error %s when trying to issue command to node %s.", err, id), "")
 	} else {
+		if body != nil {
+			defer body.Close()
+		}
+		// The body is aborted once it exceeds the limit, whatever the agent responds
+		if limited.isExceeded() {
+			handleErrorCode(w, fmt.Errorf("The request body exceeds the limit %d bytes of middleware %s.", limited.limit(), mware), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if resp == nil {
+			handleError(w, fmt.Errorf("No response of command for node %s.", id), "")
+			return
+		}
+		if resp.GetResponseCode() == common.FORBIDDEN {
+			handleErrorCode(w, fmt.Errorf("The request is refused by node %s: %s", id, resp.GetDescription()), http.StatusForbidden)
+			return
+		}
 		if resp.GetResponseCode() != common.OK {
 			handleError(w, fmt.Errorf("Found error %s when trying to get command result for node %s.", resp.GetDescription(), id), "")
 			return
 		}
 		if hr, ok := resp.(*common.HttpResponse); ok {
-			if hr.HttpResponseCode != 200 {
-				http.Error(w, hr.HttpResponseText, hr.HttpResponseCode)
+			recordLatency(span, time.Since(start), hr)
+			if upgrade && hr.HttpResponseCode == http.StatusSwitchingProtocols {
+				done(strconv.Itoa(hr.HttpResponseCode))
+				spliceUpgrade(w, hr, body, upstream, id)
+				return
 			}
-			if hr.Header != nil {
-				for k, _ := range hr.Header {
-					w.Header().Set(k, hr.Header.Get(k))
+			for k, vs := range hr.Header {
+				for _, v := range vs {
+					w.Header().Add(k, v)
 				}
 			}
-			if hr.Body != nil {
-				w.Write(hr.Body)
-				return
+			w.WriteHeader(hr.HttpResponseCode)
+			done(strconv.Itoa(hr.HttpResponseCode))
+			if body != nil {
+				// Abort the stream if the caller disconnects, so the agent cancels the request to service
+				go func() {
+					<-req.Context().Done()
+					body.Close()
+				}()
+				if err := copyAndFlush(w, body); err != nil {
+					common.Log.Errorf("Failed to copy response body from node %s: %v", id, err)
+				} else {
+					writeTrailers(w, body)
+				}
 			}
 		} else {
 			handleError(w, fmt.Errorf("Not a valid http-response when get command result for node %s.", id), "")
@@ -161,14 +315,66 @@ func processRequest(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// The escaped path after /wh/{id}/{mware}/, so that the encoded characters such as %2F and %23 are kept as is
+func proxyPath(req *http.Request) string {
+	parts := strings.SplitN(req.URL.EscapedPath(), "/", 5)
+	if len(parts) < 5 {
+		return ""
+	}
+	return parts[4]
+}
+
+// Write the trailers of the response body after the body is copied, they are sent only if the response is chunked
+func writeTrailers(w http.ResponseWriter, body io.Reader) {
+	tb, ok := body.(interface{ Trailers() http.Header })
+	if !ok {
+		return
+	}
+	for k, vs := range tb.Trailers() {
+		for _, v := range vs {
+			w.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
+
+// Copy the body to the response writer, and flush every chunk as soon as it arrives, so that the server-sent events
+// and chunked responses are passed through incrementally.
+func copyAndFlush(w http.ResponseWriter, body io.Reader) error {
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	buf := make([]byte, common.BodyChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
 func mlist(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	vars := mux.Vars(req)
 	id := vars["id"]
-	if nodes, err := common.NewMWMemoryCache().List(id); err != nil {
+	if nodes, err := common.GetMiddlewareManager().List(id); err != nil {
 		handleError(w, err, "")
 	} else {
-		jsonResponse(nodes, w)
+		views := make([]middlewareView, 0, len(nodes))
+		for _, n := range nodes {
+			views = append(views, middlewareView{Middleware: n, Health: common.GetMiddlewareHealth(id, n.Name)})
+		}
+		jsonResponse(views, w)
 	}
 }
 
@@ -182,13 +388,40 @@ func mupdate(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		handleError(w, err, "")
 	}
-	if n, err := common.NewMWMemoryCache().Update(id, mw); err != nil {
+	// The middleware declared by agent is taken over by operator once it's updated
+	mw.Source = common.SourceOperator
+	old, _ := common.GetMiddlewareManager().GetByName(id, mw.Name)
+	if old != nil && old.IsTCP() {
+		common.StopForward(id, old.Name)
+	}
+	if mw.IsTCP() {
+		if err := common.StartForward(id, &mw); err != nil {
+			restoreForward(id, old)
+			handleError(w, err, "")
+			return
+		}
+	}
+	if n, err := common.GetMiddlewareManager().Update(id, mw); err != nil {
+		if mw.IsTCP() {
+			common.StopForward(id, mw.Name)
+		}
+		restoreForward(id, old)
 		handleError(w, err, "")
 	} else {
+		common.SyncHealthTargets(id)
 		jsonResponse(n, w)
 	}
 }
 
+// Restart the forward of the tcp middleware which fails to be updated
+func restoreForward(id string, mw *common.Middleware) {
+	if mw != nil && mw.IsTCP() {
+		if err := common.StartForward(id, mw); err != nil {
+			common.Log.Errorf("Failed to restore forward for middleware %s of node %s: %v", mw.Name, id, err)
+		}
+	}
+}
+
 func mregister(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	vars := mux.Vars(req)
@@ -199,9 +432,20 @@ func mregister(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		handleError(w, err, "")
 	}
-	if n, err := common.NewMWMemoryCache().Add(id, mware); err != nil {
+	mware.Source = common.SourceOperator
+	if mware.IsTCP() {
+		if err := common.StartForward(id, &mware); err != nil {
+			handleError(w, err, "")
+			return
+		}
+	}
+	if n, err := common.GetMiddlewareManager().Add(id, mware); err != nil {
+		if mware.IsTCP() {
+			common.StopForward(id, mware.Name)
+		}
 		handleError(w, err, "")
 	} else {
+		common.SyncHealthTargets(id)
 		jsonResponse(n, w)
 	}
 }
@@ -211,37 +455,48 @@ func mdelete(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	id := vars["id"]
 	name := vars["name"]
-	if err := common.NewMWMemoryCache().DeleteByName(id, name); err != nil {
+	if err := common.GetMiddlewareManager().DeleteByName(id, name); err != nil {
 		handleError(w, err, "")
 	} else {
+		common.StopForward(id, name)
+		common.SyncHealthTargets(id)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(fmt.Sprintf("%s under node %s is deleted.", name, id)))
 	}
 }
 
-func CreateRestServer(srv string, port int) *http.Server {
+func CreateRestServer(srv string, port int, auth common.AuthConfig, maxHeaderBytes int, writeTimeout int) (*http.Server, error) {
+	if err := validateAuthConfig(auth); err != nil {
+		return nil, err
+	}
+	a := &authenticator{conf: auth}
 	r := mux.NewRouter()
 
-	r.HandleFunc("/nodes/register", register).Methods(http.MethodPost)
-	r.HandleFunc("/nodes/{id}", delete).Methods(http.MethodDelete)
-	r.HandleFunc("/nodes/", update).Methods(http.MethodPut)
-	r.HandleFunc("/nodes/", list).Methods(http.MethodGet)
+	r.HandleFunc("/nodes/register", a.authorize(permNode, register)).Methods(http.MethodPost)
+	r.HandleFunc("/nodes/{id}", a.authorize(permNode, delete)).Methods(http.MethodDelete)
+	r.HandleFunc("/nodes/", a.authorize(permNode, update)).Methods(http.MethodPut)
+	r.HandleFunc("/nodes/", a.authorize(permRead, list)).Methods(http.MethodGet)
+	r.HandleFunc("/metrics", a.authorize(permRead, unscoped(promhttp.Handler().ServeHTTP))).Methods(http.MethodGet)
+	r.HandleFunc("/nodes/{id}/status", a.authorize(permRead, status)).Methods(http.MethodGet)
 
-	r.HandleFunc("/nodes/{id}/mware", mlist).Methods(http.MethodGet)
-	r.HandleFunc("/nodes/{id}/mware", mregister).Methods(http.MethodPost)
-	r.HandleFunc("/nodes/{id}/mware", mupdate).Methods(http.MethodPut)
-	r.HandleFunc("/nodes/{id}/mware/{name}", mdelete).Methods(http.MethodDelete)
+	r.HandleFunc("/nodes/{id}/mware", a.authorize(permRead, mlist)).Methods(http.MethodGet)
+	r.HandleFunc("/nodes/{id}/mware", a.authorize(permMiddleware, mregister)).Methods(http.MethodPost)
+	r.HandleFunc("/nodes/{id}/mware", a.authorize(permMiddleware, mupdate)).Methods(http.MethodPut)
+	r.HandleFunc("/nodes/{id}/mware/{name}", a.authorize(permMiddleware, mdelete)).Methods(http.MethodDelete)
 
-	r.HandleFunc("/wh/{id}/{mware}/{rest:[a-zA-Z0-9_=\\-\\/@\\.:%\\+~#\\?&]+}", processRequest).Methods(http.MethodPost, http.MethodGet, http.MethodDelete, http.MethodPut)
+	r.HandleFunc("/wh/{id}/{mware}/{rest:.*}", a.authorize(permProxy, processRequest)).Methods(http.MethodPost, http.MethodGet, http.MethodDelete, http.MethodPut, http.MethodPatch, http.MethodHead)
 
 	server := &http.Server{
 		Addr: fmt.Sprintf("%s:%d", srv, port),
-		// Good practice to set timeouts to avoid Slowloris attacks.
-		WriteTimeout: time.Second * 60 * 5,
+		// Good practice to set timeouts to avoid Slowloris attacks. The write timeout covers the whole response, so it's
+		// disabled by default for the server-sent events and long chunked responses proxied through /wh/ routes.
+		WriteTimeout: time.Duration(writeTimeout) * time.Second,
 		ReadTimeout:  time.Second * 60 * 5,
 		IdleTimeout:  time.Second * 60,
-		Handler:      handlers.CORS(handlers.AllowedHeaders([]string{"Accept", "Accept-Language", "Content-Type", "Content-Language", "Origin"}))(r),
+		// The default 1MB is used if it's 0
+		MaxHeaderBytes: maxHeaderBytes,
+		Handler:        handlers.CORS(handlers.AllowedHeaders([]string{"Accept", "Accept-Language", "Content-Type", "Content-Language", "Origin", HeaderAuthorization, HeaderApiKey, HeaderTimeout}))(r),
 	}
 	server.SetKeepAlivesEnabled(false)
-	return server
+	return server, nil
 }
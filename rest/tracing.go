@@ -0,0 +1,47 @@
+package rest
+
+import (
+	"context"
+	"github.com/emqx/wormhole/common"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"time"
+)
+
+// Start the span of proxied request as a child of the trace context of caller, and propagate the span to the agent
+// through the headers of request
+func startProxySpan(req *http.Request, id, mware string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), req.Header)
+	ctx, span := common.Tracer().Start(ctx, "proxy "+mware,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			common.AttrAgent.String(id),
+			common.AttrMiddleware.String(mware),
+			semconv.HTTPMethodKey.String(req.Method),
+		))
+	otel.GetTextMapPropagator().Inject(ctx, req.Header)
+	return ctx, span
+}
+
+// Split the latency until the response header arrives into the time spent in the service and in the tunnel
+func recordLatency(span trace.Span, elapsed time.Duration, hr *common.HttpResponse) {
+	if hr.UpstreamTime <= 0 {
+		return
+	}
+	upstream := time.Duration(hr.UpstreamTime)
+	span.SetAttributes(
+		common.AttrUpstreamTime.Float64(common.DurationMs(upstream)),
+		common.AttrTunnelTime.Float64(common.DurationMs(elapsed-upstream)),
+	)
+}
+
+func endProxySpan(span trace.Span, code int) {
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(code))
+	if code >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(code))
+	}
+	span.End()
+}
@@ -0,0 +1,43 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/emqx/wormhole/common"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Take over the connection of caller after the service in agent side switched protocols, such as websocket, and then
+// splice the data in both directions until either side closes the connection.
+func spliceUpgrade(w http.ResponseWriter, hr *common.HttpResponse, body io.Reader, upstream *io.PipeWriter, id string) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		handleError(w, fmt.Errorf("The connection cannot be upgraded for node %s.", id), "")
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		handleError(w, fmt.Errorf("Failed to upgrade the connection for node %s: %v", id, err), "")
+		return
+	}
+	defer conn.Close()
+	// The timeouts of rest server are not applied to the upgraded connection
+	conn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(brw, "HTTP/1.1 %d %s\r\n", hr.HttpResponseCode, http.StatusText(hr.HttpResponseCode))
+	hr.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		common.Log.Errorf("Failed to switch protocols for node %s: %v", id, err)
+		return
+	}
+
+	go func() {
+		_, err := io.Copy(upstream, brw)
+		upstream.CloseWithError(err)
+	}()
+	if _, err := io.Copy(conn, body); err != nil {
+		common.Log.Debugf("The upgraded connection to node %s is broken: %v", id, err)
+	}
+}
@@ -21,6 +21,7 @@ import (
 
 type WormholeServer struct {
 	BindAddr string
+	TlsConf  *tls.Config
 }
 
 func NewServer() {
@@ -30,12 +31,41 @@ func NewServer() {
 		return
 	}
 
-	ws := &WormholeServer{fmt.Sprintf("%s:%d", conf.Basic.BindAddr, conf.Basic.BindPort)}
+	common.SetMaxFrameSize(conf.Basic.MaxFrameSize)
+	if err := common.InitManagers(conf.Store); err != nil {
+		fmt.Printf("Failed to init store: %v, exiting...\n", err)
+		return
+	}
+
+	common.RegisterServerMetrics()
+	shutdownTracing, err := common.InitTracing(conf.Tracing, "wormhole-server")
+	if err != nil {
+		fmt.Printf("Failed to init tracing: %v, exiting...\n", err)
+		return
+	}
+
+	if err := common.InitForwards(common.GetForwardBindAddr()); err != nil {
+		fmt.Printf("Failed to init forwards: %v, exiting...\n", err)
+		return
+	}
+
+	tlsConf, err := createTLSConfig(conf.Tls)
+	if err != nil {
+		fmt.Printf("Failed to init tls: %v, exiting...\n", err)
+		return
+	}
+
+	ws := &WormholeServer{BindAddr: fmt.Sprintf("%s:%d", conf.Basic.BindAddr, conf.Basic.BindPort), TlsConf: tlsConf}
 	go func() { ws.Start() }()
 
+	var srvRest *http.Server
 	if conf.Rest.EnableRest {
 		//Start rest service
-		srvRest := rest.CreateRestServer(conf.Rest.RestBindAddr, conf.Rest.RestBindPort)
+		srvRest, err = rest.CreateRestServer(conf.Rest.RestBindAddr, conf.Rest.RestBindPort, conf.Rest.Auth, conf.Rest.MaxHeaderBytes, conf.Rest.WriteTimeout)
+		if err != nil {
+			fmt.Printf("Failed to init rest service: %v, exiting...\n", err)
+			return
+		}
 		go func() {
 			var err error
 			err = srvRest.ListenAndServe()
@@ -49,43 +79,78 @@ func NewServer() {
 	sigint := make(chan os.Signal, 1)
 	signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
 	<-sigint
+	// Stop serving the rest api before closing the store, so that no write is in flight
+	if srvRest != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		srvRest.Shutdown(ctx)
+		cancel()
+	}
+	common.CloseManagers()
+	shutdownTracing()
 	os.Exit(0)
 }
 
 // Start a rest that echos all data on the first stream opened by the internal
 func (ws *WormholeServer) Start() {
-	listener, err := quic.ListenAddr(ws.BindAddr, generateTLSConfig(), &quic.Config{KeepAlive: true, HandshakeTimeout: 10 * time.Second})
+	listener, err := quic.ListenAddr(ws.BindAddr, ws.TlsConf, &quic.Config{KeepAlive: true, HandshakeTimeout: 10 * time.Second})
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 	for {
-		context, cancel := context.WithCancel(context.Background())
-
-		sess, err := listener.Accept(context)
+		sess, err := listener.Accept(context.Background())
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
+		ctx, cancel := context.WithCancel(context.Background())
 		go func() {
-			gstream, err := sess.AcceptStream(context)
-			//fmt.Println("Accepted stream.")
+			// The first stream opened by the client is the control stream
+			gstream, err := sess.AcceptStream(ctx)
 			if err != nil {
-				panic(err)
-			}
-			conn := common.QuicConnection{
-				Session: sess,
-				Stream:  gstream,
-				Cancel:  cancel,
+				cancel()
+				common.Log.Errorf("Failed to accept the control stream: %v", err)
+				return
 			}
+			conn := common.NewQuicConnection(sess, gstream, cancel)
 			conn.ListenToClient()
 		}()
 	}
 }
 
+// Create the TLS config of QUIC listener with the configured certificate. A client certificate signed by the
+// configured CA is required if the CA file is specified.
+func createTLSConfig(conf common.TlsConfig) (*tls.Config, error) {
+	var tlsConf *tls.Config
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load certificate %s and key %s: %v", conf.CertFile, conf.KeyFile, err)
+		}
+		tlsConf = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"emqx-wormhole"},
+		}
+	} else {
+		common.Log.Warnf("No certificate is configured, a self-signed certificate is generated and clients cannot verify the server.")
+		tlsConf = generateTLSConfig()
+	}
+	if conf.CaFile != "" {
+		pool, err := common.LoadCertPool(conf.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.ClientCAs = pool
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if conf.BindIdentifier {
+		return nil, fmt.Errorf("The caFile is required when bindIdentifier is enabled")
+	}
+	return tlsConf, nil
+}
+
 // Setup a bare-bones TLS config for the rest
 func generateTLSConfig() *tls.Config {
-	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		panic(err)
 	}